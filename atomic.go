@@ -0,0 +1,223 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// AtomicWriter writes files atomically, it writes to a temporary file in
+// the same directory, syncs the file, renames it over the target and then
+// syncs the directory, so readers never see a partially written file.
+//
+// Symbolic links are followed, so their targets are replaced. The owner
+// of the existing file is kept where permitted, e.g. running as root,
+// otherwise the file is owned by the current user.
+type AtomicWriter struct {
+	// Perm is the permission of new files before umask, defaults to 0644.
+	Perm os.FileMode
+
+	// PreservePerm keeps the permission of the existing file.
+	PreservePerm bool
+
+	// Exclusive fails with an error satisfying errors.Is(err, fs.ErrExist)
+	// if the file exists.
+	Exclusive bool
+
+	// Append keeps the existing content and appends to it, otherwise the
+	// file is truncated.
+	Append bool
+}
+
+// AtomicFile is a file being written by AtomicWriter, it replaces the
+// target on Commit and is discarded on Close without Commit.
+type AtomicFile struct {
+	*os.File
+
+	path string
+	w    *AtomicWriter
+	done bool
+}
+
+// WriteFile writes data to the file atomically.
+func (w *AtomicWriter) WriteFile(path string, data []byte) error {
+	f, err := w.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// Create creates a temporary file next to path, which replaces path on Commit.
+func (w *AtomicWriter) Create(path string) (*AtomicFile, error) {
+	perm := w.Perm
+	if perm == 0 {
+		perm = 0644
+	}
+	path, err := resolveLink(path)
+	if err != nil {
+		return nil, err
+	}
+	preserve := false
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && w.Exclusive:
+		return nil, &os.PathError{Op: "create", Path: path, Err: os.ErrExist}
+	case err == nil && info.IsDir():
+		return nil, &os.PathError{Op: "create", Path: path, Err: errors.New("is a directory")}
+	case err == nil && w.PreservePerm:
+		perm, preserve = info.Mode().Perm(), true
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+
+	dir, base := filepath.Split(path)
+	var tmp *os.File
+	for i := 0; i < 10; i++ {
+		name := filepath.Join(dir, "."+base+"."+RandString(8, "lower")+".tmp")
+		tmp, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &AtomicFile{File: tmp, path: path, w: w}
+	if info != nil {
+		chown(tmp.Name(), info)
+	}
+
+	// Permissions of new files are masked by umask, but not preserved ones.
+	if preserve {
+		if err := tmp.Chmod(perm); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if w.Append {
+		if err := f.copyExisting(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// resolveLink returns the path that the symbolic link points to, which
+// may not exist.
+func resolveLink(path string) (string, error) {
+	for i := 0; i < 255; i++ {
+		info, err := os.Lstat(path)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return "", &os.PathError{Op: "create", Path: path, Err: errors.New("too many levels of symbolic links")}
+}
+
+func (f *AtomicFile) copyExisting() error {
+	src, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(f.File, src)
+	return err
+}
+
+// Commit syncs the file and renames it over the target.
+func (f *AtomicFile) Commit() (err error) {
+	if f.done {
+		return fmt.Errorf("commit %s: already closed", f.path)
+	}
+	f.done = true
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if err = f.File.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+	if err = f.File.Close(); err != nil {
+		return err
+	}
+
+	if f.w.Exclusive {
+		// Link fails if the target exists, which is race free.
+		err = os.Link(tmp, f.path)
+		if err == nil || os.IsExist(err) {
+			os.Remove(tmp)
+			if err != nil {
+				return err
+			}
+			return syncDir(filepath.Dir(f.path))
+		}
+		if _, err = os.Lstat(f.path); err == nil {
+			return &os.PathError{Op: "create", Path: f.path, Err: os.ErrExist}
+		}
+	}
+	if err = os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(f.path))
+}
+
+// Close discards the file if not committed.
+func (f *AtomicFile) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	err := f.File.Close()
+	if rmErr := os.Remove(f.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// syncDir syncs the directory to persist renames, it is not supported
+// on Windows.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,263 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBrowserNotFound is returned when no browser is found.
+var ErrBrowserNotFound = errors.New("browser not found")
+
+// Kinds of browsers.
+const (
+	BrowserChrome        = "chrome"
+	BrowserChromium      = "chromium"
+	BrowserEdge          = "edge"
+	BrowserBrave         = "brave"
+	BrowserHeadlessShell = "headless-shell"
+)
+
+// Sources of browsers.
+const (
+	SourceEnv        = "env"        // The CHROME_BIN environment variable
+	SourceSystem     = "system"     // PATH and the known locations
+	SourceFlatpak    = "flatpak"    // Exported Flatpak applications
+	SourcePlaywright = "playwright" // The browser cache of Playwright
+	SourcePuppeteer  = "puppeteer"  // The browser cache of Puppeteer
+)
+
+// browserVersionTimeout limits running browsers for their versions.
+var browserVersionTimeout = 5 * time.Second
+
+// Browser is a Chromium based browser.
+type Browser struct {
+	Path        string // Absolute path of the executable
+	Kind        string // One of the Browser* kinds
+	Source      string // One of the Source* sources
+	Version     string // Version, e.g. 120.0.6099.109, empty if unknown
+	Major       int    // Major version, 0 if unknown
+	HeadlessNew bool   // Whether it supports --headless=new
+}
+
+// FindBrowsers returns the browsers found in the system, in order of the
+// sources, and the browsers in caches are ordered by versions, newest
+// first. It returns ErrBrowserNotFound if none is found.
+func FindBrowsers(ctx context.Context) ([]Browser, error) {
+	browsers := []Browser{}
+	seen := make(map[string]bool)
+	for _, c := range browserCandidates() {
+		path, err := exec.LookPath(c.path)
+		if err != nil {
+			continue
+		}
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			real = path
+		}
+		if seen[real] {
+			continue
+		}
+		seen[real] = true
+
+		browsers = append(browsers, inspectBrowser(ctx, path, c.source))
+	}
+	if len(browsers) == 0 {
+		return nil, ErrBrowserNotFound
+	}
+
+	// Candidates of a source are in order of preference, except the
+	// caches, which may have many versions.
+	order := map[string]int{SourceEnv: 0, SourceSystem: 1, SourceFlatpak: 2, SourcePlaywright: 3, SourcePuppeteer: 4}
+	sort.SliceStable(browsers, func(i, j int) bool {
+		a, b := browsers[i], browsers[j]
+		if a.Source != b.Source {
+			return order[a.Source] < order[b.Source]
+		}
+		if a.Source == SourcePlaywright || a.Source == SourcePuppeteer {
+			return compareVersion(a.Version, b.Version) > 0
+		}
+		return false
+	})
+
+	return browsers, nil
+}
+
+// FindBrowser returns the first browser of FindBrowsers.
+func FindBrowser(ctx context.Context) (*Browser, error) {
+	browsers, err := FindBrowsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &browsers[0], nil
+}
+
+// inspectBrowser returns the browser of the path with its version.
+func inspectBrowser(ctx context.Context, path, source string) Browser {
+	b := Browser{Path: path, Kind: browserKind(path), Source: source}
+	if runtime.GOOS == "windows" {
+		// Browsers on Windows open a window instead of printing the
+		// version, which is read from the installation.
+		b.Version = installedVersion(filepath.Dir(path))
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, browserVersionTimeout)
+		defer cancel()
+		tool := &Tool{Name: b.Kind, Paths: []string{path}, VersionArgs: []string{"--version"}}
+		b.Version, _ = tool.Version(ctx)
+	}
+	if b.Version != "" {
+		b.Major, _ = strconv.Atoi(strings.SplitN(b.Version, ".", 2)[0])
+	}
+	// The new headless mode is available since Chrome 109, and is not
+	// included in the headless shell.
+	b.HeadlessNew = b.Major >= 109 && b.Kind != BrowserHeadlessShell
+
+	return b
+}
+
+// installedVersion returns the newest version of the installation in dir,
+// which has a directory or a manifest named by the version, e.g.
+// 120.0.6099.109 or 120.0.6099.109.manifest.
+func installedVersion(dir string) (version string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".manifest")
+		if versionRegexp.FindString(name) != name || !strings.Contains(name, ".") {
+			continue
+		}
+		if version == "" || compareVersion(name, version) > 0 {
+			version = name
+		}
+	}
+	return version
+}
+
+type browserCandidate struct {
+	path   string
+	source string
+}
+
+// browserCandidates returns the names and paths of browsers to look up.
+func browserCandidates() []browserCandidate {
+	var candidates []browserCandidate
+	add := func(source string, paths ...string) {
+		for _, path := range paths {
+			candidates = append(candidates, browserCandidate{path: path, source: source})
+		}
+	}
+	if path := os.Getenv("CHROME_BIN"); path != "" {
+		add(SourceEnv, path)
+	}
+	add(SourceSystem, chromePaths()...)
+
+	home, _ := os.UserHomeDir()
+	switch runtime.GOOS {
+	case "darwin":
+		add(SourceSystem,
+			"/Applications/Microsoft Edge.app/Contents/MacOS/Microsoft Edge",
+			"/Applications/Brave Browser.app/Contents/MacOS/Brave Browser",
+		)
+		add(SourcePlaywright, glob(cacheDir("PLAYWRIGHT_BROWSERS_PATH", home, "Library/Caches/ms-playwright"),
+			"chromium-*/chrome-mac/Chromium.app/Contents/MacOS/Chromium",
+			"chromium_headless_shell-*/chrome-mac/headless_shell",
+		)...)
+		add(SourcePuppeteer, glob(cacheDir("PUPPETEER_CACHE_DIR", home, ".cache/puppeteer"),
+			"chrome/mac*/chrome-mac*/Google Chrome for Testing.app/Contents/MacOS/Google Chrome for Testing",
+			"chrome-headless-shell/mac*/chrome-headless-shell-mac*/chrome-headless-shell",
+		)...)
+	case "windows":
+		add(SourceSystem,
+			"msedge",
+			`C:\Program Files (x86)\Microsoft\Edge\Application\msedge.exe`,
+			`C:\Program Files\Microsoft\Edge\Application\msedge.exe`,
+			"brave",
+			`C:\Program Files\BraveSoftware\Brave-Browser\Application\brave.exe`,
+		)
+		add(SourcePlaywright, glob(cacheDir("PLAYWRIGHT_BROWSERS_PATH", os.Getenv("LOCALAPPDATA"), "ms-playwright"),
+			`chromium-*\chrome-win\chrome.exe`,
+			`chromium_headless_shell-*\chrome-win\headless_shell.exe`,
+		)...)
+		add(SourcePuppeteer, glob(cacheDir("PUPPETEER_CACHE_DIR", home, ".cache/puppeteer"),
+			`chrome\win*\chrome-win*\chrome.exe`,
+			`chrome-headless-shell\win*\chrome-headless-shell-win*\chrome-headless-shell.exe`,
+		)...)
+	default:
+		add(SourceSystem,
+			"microsoft-edge",
+			"microsoft-edge-stable",
+			"/opt/microsoft/msedge/msedge",
+			"brave-browser",
+			"brave",
+			"/opt/brave.com/brave/brave",
+		)
+		for _, dir := range []string{"/var/lib/flatpak/exports/bin", filepath.Join(home, ".local/share/flatpak/exports/bin")} {
+			for _, app := range []string{"com.google.Chrome", "org.chromium.Chromium", "com.microsoft.Edge", "com.brave.Browser"} {
+				add(SourceFlatpak, filepath.Join(dir, app))
+			}
+		}
+		add(SourcePlaywright, glob(cacheDir("PLAYWRIGHT_BROWSERS_PATH", home, ".cache/ms-playwright"),
+			"chromium-*/chrome-linux/chrome",
+			"chromium_headless_shell-*/chrome-linux/headless_shell",
+		)...)
+		add(SourcePuppeteer, glob(cacheDir("PUPPETEER_CACHE_DIR", home, ".cache/puppeteer"),
+			"chrome/linux-*/chrome-linux64/chrome",
+			"chrome-headless-shell/linux-*/chrome-headless-shell-linux64/chrome-headless-shell",
+		)...)
+	}
+
+	return candidates
+}
+
+// cacheDir returns the directory of the environment variable, or the
+// directory under base.
+func cacheDir(env, base, dir string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+	if base == "" {
+		return ""
+	}
+	return filepath.Join(base, filepath.FromSlash(dir))
+}
+
+// glob returns the paths matching the patterns under dir.
+func glob(dir string, patterns ...string) (paths []string) {
+	if dir == "" {
+		return nil
+	}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
+// browserKind returns the kind of the browser by its file name.
+func browserKind(path string) string {
+	p := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.Contains(p, "edge"):
+		return BrowserEdge
+	case strings.Contains(p, "brave"):
+		return BrowserBrave
+	case strings.Contains(p, "headless_shell"), strings.Contains(p, "headless-shell"):
+		return BrowserHeadlessShell
+	case strings.Contains(p, "chromium"):
+		return BrowserChromium
+	}
+	return BrowserChrome
+}
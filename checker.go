@@ -0,0 +1,243 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statuses of a link reported by Checker.
+const (
+	LinkAlive      = "alive"
+	LinkGone       = "gone"
+	LinkSoft404    = "soft-404"
+	LinkRedirected = "redirected"
+	LinkBlocked    = "blocked"
+	LinkDNSFailure = "dns-failure"
+	LinkTLSFailure = "tls-failure"
+	LinkTimeout    = "timeout"
+	LinkError      = "error"
+)
+
+// maxCheckBody is the maximum size of body read for classification.
+const maxCheckBody = 64 << 10
+
+// LinkResult is the result of checking a link.
+type LinkResult struct {
+	URL        string
+	Status     string // One of the Link* statuses
+	StatusCode int    // HTTP status code of the final response, if any
+	Final      string // Final URL after redirects
+	Err        error  // Error of the request, if any
+	Duration   time.Duration
+}
+
+// Checker checks the liveness of links concurrently.
+type Checker struct {
+	// Client sends requests, DefaultClient is used if nil.
+	Client *Client
+
+	// Concurrency is the maximum number of links checked at the
+	// same time, defaults to 8.
+	Concurrency int
+
+	// HostInterval is the minimum interval between two requests
+	// to the same host, zero means no limit.
+	HostInterval time.Duration
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// Check checks the links, results are in the order of links.
+func (ch *Checker) Check(ctx context.Context, links []string) []LinkResult {
+	n := ch.Concurrency
+	if n <= 0 {
+		n = 8
+	}
+
+	results := make([]LinkResult, len(links))
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, link string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = ch.CheckLink(ctx, link)
+		}(i, link)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// CheckLink checks and classifies the link.
+func (ch *Checker) CheckLink(ctx context.Context, link string) LinkResult {
+	result := LinkResult{URL: link, Final: link}
+	u, err := url.Parse(link)
+	if err != nil {
+		result.Status, result.Err = LinkError, err
+		return result
+	}
+	if err := ch.wait(ctx, u.Hostname()); err != nil {
+		result.Status, result.Err = classifyError(err), err
+		return result
+	}
+
+	c := ch.Client
+	if c == nil {
+		c = DefaultClient
+	}
+
+	start := time.Now()
+	resp, err := c.do(ctx, c.httpClient(), request(http.MethodGet, link))
+	if err != nil {
+		result.Duration = time.Since(start)
+		result.Status, result.Err = classifyError(err), err
+		return result
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Status, result.Err = classifyError(err), err
+		return result
+	}
+
+	result.StatusCode = resp.StatusCode
+	result.Final = resp.Request.URL.String()
+	result.Status = classifyResponse(u, resp, body)
+
+	if c.Soft404Threshold > 0 && (result.Status == LinkAlive || result.Status == LinkRedirected) {
+		if c.soft404(ctx, u, resp.Request.URL, body) >= c.Soft404Threshold {
+			result.Status = LinkSoft404
+		}
+	}
+
+	return result
+}
+
+// wait blocks until the host could be requested.
+func (ch *Checker) wait(ctx context.Context, host string) error {
+	if ch.HostInterval <= 0 {
+		return ctx.Err()
+	}
+
+	ch.mu.Lock()
+	if ch.next == nil {
+		ch.next = make(map[string]time.Time)
+	}
+	now := time.Now()
+	at := ch.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	ch.next[host] = at.Add(ch.HostInterval)
+	ch.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func classifyResponse(u *url.URL, resp *http.Response, body []byte) string {
+	switch code := resp.StatusCode; {
+	case code == http.StatusNotFound || code == http.StatusGone:
+		return LinkGone
+	case code == http.StatusForbidden || code == http.StatusTooManyRequests ||
+		code == http.StatusUnavailableForLegalReasons:
+		return LinkBlocked
+	case isChallenge(resp, body):
+		return LinkBlocked
+	case code >= 200 && code < 300:
+		final := resp.Request.URL
+		if final.String() == u.String() {
+			return LinkAlive
+		}
+		// Redirecting a deep link to the home page is a common soft 404.
+		if strings.Trim(u.Path, "/") != "" && strings.Trim(final.Path, "/") == "" {
+			return LinkSoft404
+		}
+		return LinkRedirected
+	}
+	return LinkError
+}
+
+// isChallenge reports whether the response is a captcha or bot challenge.
+// Captcha markers are only checked in refused responses, as live pages
+// embed captcha widgets in forms.
+func isChallenge(resp *http.Response, body []byte) bool {
+	if resp.Header.Get("Cf-Mitigated") == "challenge" {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	default:
+		return false
+	}
+	body = bytes.ToLower(body)
+	for _, sign := range [][]byte{
+		[]byte("g-recaptcha"),
+		[]byte("h-captcha"),
+		[]byte("cf-challenge"),
+		[]byte("challenge-platform"),
+		[]byte("captcha-delivery"),
+	} {
+		if bytes.Contains(body, sign) {
+			return true
+		}
+	}
+	return false
+}
+
+func classifyError(err error) string {
+	var (
+		dnsErr  *net.DNSError
+		hostErr x509.HostnameError
+		authErr x509.UnknownAuthorityError
+		certErr x509.CertificateInvalidError
+		recErr  tls.RecordHeaderError
+		netErr  net.Error
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return LinkTimeout
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return LinkTimeout
+		}
+		return LinkDNSFailure
+	case errors.As(err, &hostErr), errors.As(err, &authErr),
+		errors.As(err, &certErr), errors.As(err, &recErr):
+		return LinkTLSFailure
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return LinkTimeout
+	case strings.Contains(err.Error(), "tls:") || strings.Contains(err.Error(), "x509:"):
+		return LinkTLSFailure
+	}
+	return LinkError
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const userAgent = `Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/99.0.7113.093 Safari/537.36`
+
+// DefaultClient is the Client used by NotFound, RealURI and TinyURL, it
+// refuses to connect to internal addresses blocked by DefaultGuard.
+var DefaultClient = &Client{
+	HTTPClient: &http.Client{Transport: DefaultGuard.Transport()},
+	UserAgent:  userAgent,
+	Timeout:    10 * time.Second,
+}
+
+// Client carries the HTTP settings for the URL helpers. The zero value
+// is usable, and it is safe for concurrent use.
+type Client struct {
+	// HTTPClient is used to send requests, http.DefaultClient is used if nil.
+	HTTPClient *http.Client
+
+	// UserAgent is the User-Agent header of requests, if set.
+	UserAgent string
+
+	// Timeout limits each attempt, zero means no limit except the context.
+	Timeout time.Duration
+
+	// Retries is the number of retries after a failed attempt, attempts
+	// fail on network errors, 429 and 5xx responses.
+	Retries int
+
+	// RetryWait is the wait between attempts, defaults to 500 milliseconds.
+	RetryWait time.Duration
+
+	// Soft404Threshold enables soft 404 detection if greater than zero,
+	// links with a Soft404 score not less than it are not found. It costs
+	// two more requests for every live link, 0.8 is a reasonable value.
+	Soft404Threshold float64
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// do sends the request built by newReq and retries as configured, a new
+// request is built for every attempt. The caller must close the body.
+func (c *Client) do(ctx context.Context, hc *http.Client, newReq func(ctx context.Context) (*http.Request, error)) (resp *http.Response, err error) {
+	wait := c.RetryWait
+	if wait == 0 {
+		wait = 500 * time.Millisecond
+	}
+
+	for i := 0; i <= c.Retries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		resp, err = c.attempt(ctx, hc, newReq)
+		if ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if i < c.Retries && resp != nil {
+			resp.Body.Close()
+		}
+	}
+
+	return resp, err
+}
+
+func (c *Client) attempt(ctx context.Context, hc *http.Client, newReq func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	}
+
+	req, err := newReq(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if c.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// cancelBody releases the context of an attempt once the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func request(method, uri string) func(ctx context.Context) (*http.Request, error) {
+	return func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, method, uri, nil)
+	}
+}
+
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// NotFound returns a result of URI status is 404, it also returns
+// true if the URI is unreachable, or is a soft 404 if enabled.
+func (c *Client) NotFound(ctx context.Context, uri string) bool {
+	if _, err := url.Parse(uri); err != nil {
+		return true
+	}
+
+	hc := *c.httpClient()
+	hc.CheckRedirect = noRedirect
+
+	resp, err := c.do(ctx, &hc, request(http.MethodHead, uri))
+	if err != nil {
+		return true
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return true
+	}
+	if c.Soft404Threshold <= 0 {
+		return false
+	}
+
+	score, err := c.Soft404(ctx, uri)
+	return err == nil && score >= c.Soft404Threshold
+}
+
+// RealURI returns final URL after following redirects, it returns
+// the given URL if the request fails.
+func (c *Client) RealURI(ctx context.Context, u *url.URL) *url.URL {
+	resp, err := c.do(ctx, c.httpClient(), request(http.MethodHead, u.String()))
+	if err != nil {
+		return u
+	}
+	defer resp.Body.Close()
+
+	return resp.Request.URL
+}
+
+// TinyURL shortens the link using the tinyurl.com service.
+func (c *Client) TinyURL(ctx context.Context, link string) (string, error) {
+	if _, err := url.Parse(link); err != nil {
+		return "", err
+	}
+
+	endpoint := "https://tinyurl.com/api-create.php?url=" + url.QueryEscape(link)
+	resp, err := c.do(ctx, c.httpClient(), request(http.MethodGet, endpoint))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("tinyurl: unexpected status: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	final := strings.TrimSpace(string(body))
+	if final == "" || final == "Error" {
+		return "", errors.New("tinyurl: shorten failed")
+	}
+
+	return final, nil
+}
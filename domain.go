@@ -0,0 +1,69 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Domain is a host split by the public suffix list.
+type Domain struct {
+	Host        string // The host, e.g. www.news.bbc.co.uk
+	Registrable string // The registrable domain (eTLD+1), e.g. bbc.co.uk
+	Subdomain   string // The labels before the registrable domain, e.g. www.news
+	Suffix      string // The public suffix (eTLD), e.g. co.uk
+	ICANN       bool   // Whether the suffix is managed by ICANN
+}
+
+// ParseDomain splits the host of the link, which could be a URL or a host.
+func ParseDomain(link string) (*Domain, error) {
+	host := link
+	if strings.Contains(link, "/") {
+		u, err := url.Parse(link)
+		if err != nil {
+			return nil, err
+		}
+		host = u.Hostname()
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return nil, fmt.Errorf("missing host: %s", link)
+	}
+	if net.ParseIP(host) != nil {
+		return nil, fmt.Errorf("host %s is an IP address", host)
+	}
+
+	suffix, icann := publicsuffix.PublicSuffix(host)
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Domain{
+		Host:        host,
+		Registrable: registrable,
+		Subdomain:   strings.TrimSuffix(strings.TrimSuffix(host, registrable), "."),
+		Suffix:      suffix,
+		ICANN:       icann,
+	}, nil
+}
+
+// RegistrableDomain returns the registrable domain of the link, or the
+// host if it has no registrable domain, e.g. an IP address.
+func RegistrableDomain(link string) string {
+	d, err := ParseDomain(link)
+	if err != nil {
+		if u, err := url.Parse(link); err == nil && u.Host != "" {
+			return u.Hostname()
+		}
+		return link
+	}
+	return d.Registrable
+}
@@ -0,0 +1,283 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrToolNotFound is returned when the external tool is not found.
+var ErrToolNotFound = errors.New("tool not found")
+
+// maxStderr is the maximum bytes of stderr kept in ToolError.
+const maxStderr = 4 << 10
+
+var versionRegexp = regexp.MustCompile(`\d+\.\d+(?:\.\d+){0,2}`)
+
+// Tool is an external program, such as dwebp, ffmpeg and Chrome.
+type Tool struct {
+	// Name is the name of the tool, e.g. "dwebp".
+	Name string
+
+	// Env is the environment variable overriding the path, e.g. "CHROME_BIN".
+	Env string
+
+	// Paths are the executable names looked up in PATH and the known
+	// absolute locations, in order. Defaults to Name.
+	Paths []string
+
+	// VersionArgs are the arguments printing the version, e.g. "-version".
+	VersionArgs []string
+
+	// MinVersion is the minimum version required by Run, e.g. "1.2".
+	MinVersion string
+
+	// Timeout is the timeout of Run if ctx has no deadline, 0 means no timeout.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	key     string // environment of the cached lookup
+	path    string
+	err     error
+	version map[string]string // path -> version
+}
+
+// ToolError records a failed run of an external tool.
+type ToolError struct {
+	Tool     string
+	Args     []string
+	ExitCode int    // Exit code, or -1 if not exited
+	Stderr   string // Tail of stderr
+	Err      error
+}
+
+func (e *ToolError) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Tool, e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
+// Path returns the absolute path of the tool, which is looked up in the
+// environment variable, then Paths. The result is cached until the
+// environment variable or PATH changes.
+func (t *Tool) Path() (string, error) {
+	var env string
+	if t.Env != "" {
+		env = os.Getenv(t.Env)
+	}
+	key := env + "\x00" + os.Getenv("PATH")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.key == key && (t.path != "" || t.err != nil) {
+		return t.path, t.err
+	}
+
+	t.key, t.path, t.err = key, "", nil
+	paths := t.Paths
+	if len(paths) == 0 {
+		paths = []string{t.Name}
+	}
+	if env != "" {
+		paths = append([]string{env}, paths...)
+	}
+	for _, path := range paths {
+		if found, err := exec.LookPath(path); err == nil {
+			t.path = found
+			return t.path, nil
+		}
+	}
+	t.err = fmt.Errorf("%w: %s", ErrToolNotFound, t.Name)
+
+	return t.path, t.err
+}
+
+// Version returns the version of the tool, e.g. "1.2.3", which is cached.
+func (t *Tool) Version(ctx context.Context) (string, error) {
+	path, err := t.Path()
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	version, ok := t.version[path]
+	t.mu.Unlock()
+	if ok {
+		return version, nil
+	}
+
+	cmd := exec.CommandContext(ctx, path, t.VersionArgs...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", t.error(ctx, t.VersionArgs, &stderr, err)
+	}
+	version = versionRegexp.FindString(stdout.String() + stderr.String())
+	if version == "" {
+		return "", fmt.Errorf("%s: version not found", t.Name)
+	}
+
+	t.mu.Lock()
+	if t.version == nil {
+		t.version = make(map[string]string)
+	}
+	t.version[path] = version
+	t.mu.Unlock()
+
+	return version, nil
+}
+
+// Command returns the command of the tool with the arguments, after
+// checking its version if MinVersion is set.
+func (t *Tool) Command(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	path, err := t.Path()
+	if err != nil {
+		return nil, err
+	}
+	if t.MinVersion != "" {
+		version, err := t.Version(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if compareVersion(version, t.MinVersion) < 0 {
+			return nil, fmt.Errorf("%s: version %s is older than %s", t.Name, version, t.MinVersion)
+		}
+	}
+
+	return exec.CommandContext(ctx, path, args...), nil
+}
+
+// Run runs the tool with the arguments and returns its stdout, it
+// returns *ToolError with the tail of stderr if the tool fails.
+func (t *Tool) Run(ctx context.Context, args ...string) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	cmd, err := t.Command(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.Bytes(), t.error(ctx, args, &stderr, err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (t *Tool) error(ctx context.Context, args []string, stderr *bytes.Buffer, err error) *ToolError {
+	e := &ToolError{Tool: t.Name, Args: args, ExitCode: -1, Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		e.ExitCode = exitErr.ExitCode()
+	}
+	if ctx.Err() != nil {
+		e.Err = ctx.Err()
+	}
+	msg := stderr.Bytes()
+	if len(msg) > maxStderr {
+		msg = msg[len(msg)-maxStderr:]
+	}
+	e.Stderr = string(bytes.TrimSpace(msg))
+
+	return e
+}
+
+// compareVersion compares dotted versions, it returns -1, 0 or 1.
+func compareVersion(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// ToolRegistry is a registry of external tools.
+type ToolRegistry struct {
+	mu    sync.Mutex
+	tools map[string]*Tool
+}
+
+// DefaultTools is the registry of the tools used by the package, which
+// includes dwebp, cwebp, avifdec, heif-convert, chrome, ffmpeg, yt-dlp,
+// youtube-dl and single-file.
+var DefaultTools = NewToolRegistry(
+	&Tool{Name: "dwebp", Env: "DWEBP_BIN", VersionArgs: []string{"-version"}, Timeout: 2 * time.Minute},
+	&Tool{Name: "cwebp", Env: "CWEBP_BIN", VersionArgs: []string{"-version"}, Timeout: 2 * time.Minute},
+	&Tool{Name: "avifdec", Env: "AVIFDEC_BIN", VersionArgs: []string{"--version"}, Timeout: 2 * time.Minute},
+	&Tool{Name: "heif-convert", Env: "HEIF_CONVERT_BIN", VersionArgs: []string{"--version"}, Timeout: 2 * time.Minute},
+	&Tool{Name: "chrome", Env: "CHROME_BIN", Paths: chromePaths(), VersionArgs: []string{"--version"}},
+	&Tool{Name: "ffmpeg", Env: "FFMPEG_BIN", VersionArgs: []string{"-version"}},
+	&Tool{Name: "yt-dlp", Env: "YT_DLP_BIN", VersionArgs: []string{"--version"}},
+	&Tool{Name: "youtube-dl", Env: "YOUTUBE_DL_BIN", VersionArgs: []string{"--version"}},
+	&Tool{Name: "single-file", Env: "SINGLE_FILE_BIN", VersionArgs: []string{"--version"}},
+)
+
+// NewToolRegistry returns a registry of the tools.
+func NewToolRegistry(tools ...*Tool) *ToolRegistry {
+	r := &ToolRegistry{tools: make(map[string]*Tool)}
+	for _, t := range tools {
+		r.Register(t)
+	}
+	return r
+}
+
+// Register registers the tool, replacing the tool of the same name.
+func (r *ToolRegistry) Register(t *Tool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tools[t.Name] = t
+}
+
+// Lookup returns the tool of the name, an unknown tool is registered to
+// be looked up in PATH.
+func (r *ToolRegistry) Lookup(name string) *Tool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tools[name]
+	if !ok {
+		t = &Tool{Name: name}
+		r.tools[name] = t
+	}
+	return t
+}
+
+// LookupTool returns the tool of the name from DefaultTools.
+func LookupTool(name string) *Tool {
+	return DefaultTools.Lookup(name)
+}
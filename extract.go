@@ -0,0 +1,121 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"net/url"
+	"strings"
+
+	"mvdan.cc/xurls/v2"
+)
+
+// Kinds of links matched by Extractor.
+const (
+	KindStrict  = "strict"  // Link with a scheme, e.g. https://example.com
+	KindRelaxed = "relaxed" // Link without a scheme, e.g. example.com
+	KindEmail   = "email"   // Email address, with or without mailto scheme
+	KindMagnet  = "magnet"  // Magnet link
+)
+
+// URLMatch is a link extracted from text.
+type URLMatch struct {
+	Original string // Text of the link as it appeared
+	URL      string // The link completed and stripped
+	Start    int    // Byte offset of the start in text
+	End      int    // Byte offset of the end in text
+	Line     int    // Line number of the start, starting from 1
+	Kind     string // One of the Kind* kinds
+}
+
+// Extractor extracts links from text. The zero value matches links with
+// a scheme, and strips them using default rules.
+type Extractor struct {
+	// Relaxed matches links without a scheme and email addresses,
+	// see xurls.Relaxed.
+	Relaxed bool
+
+	// Schemes restricts the schemes of links, e.g. "https", "mailto".
+	// Links without a scheme are completed with https, and email
+	// addresses with mailto. Empty allows all schemes.
+	Schemes []string
+
+	// Rules strips the HTTP links, default rules are used if nil.
+	Rules *RuleSet
+}
+
+// Extract returns the links in text, in the order of appearance.
+func (e *Extractor) Extract(text string) []URLMatch {
+	rx := xurls.Strict()
+	if e.Relaxed {
+		rx = xurls.Relaxed()
+	}
+
+	matches := []URLMatch{}
+	line, last := 1, 0
+	for _, loc := range rx.FindAllStringIndex(text, -1) {
+		line += strings.Count(text[last:loc[0]], "\n")
+		last = loc[0]
+
+		m, ok := e.match(text[loc[0]:loc[1]])
+		if !ok {
+			continue
+		}
+		m.Start, m.End, m.Line = loc[0], loc[1], line
+		matches = append(matches, m)
+	}
+
+	return matches
+}
+
+func (e *Extractor) match(original string) (URLMatch, bool) {
+	link := original
+	switch {
+	case xurls.Strict().FindString(original) == original:
+	case strings.Contains(original, "@") && !strings.Contains(original, "/"):
+		link = "mailto:" + original
+	default:
+		return e.complete(original, "https://"+original, KindRelaxed)
+	}
+	return e.complete(original, link, "")
+}
+
+// complete parses the absolute link, and returns the match if its scheme
+// is allowed. The kind is determined by the scheme if empty.
+func (e *Extractor) complete(original, link, kind string) (m URLMatch, ok bool) {
+	m = URLMatch{Original: original, URL: link, Kind: kind}
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme == "" || !e.allow(u.Scheme) {
+		return m, false
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if m.Kind == "" {
+		switch scheme {
+		case "magnet":
+			m.Kind = KindMagnet
+		case "mailto":
+			m.Kind = KindEmail
+		default:
+			m.Kind = KindStrict
+		}
+	}
+	if scheme == "http" || scheme == "https" {
+		m.URL = e.Rules.Strip(link)
+	}
+
+	return m, true
+}
+
+func (e *Extractor) allow(scheme string) bool {
+	if len(e.Schemes) == 0 {
+		return true
+	}
+	for _, s := range e.Schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrNoSnapshot is returned by FallbackProvider if no snapshot found.
+var ErrNoSnapshot = errors.New("no snapshot found")
+
+// Snapshot is an archived copy of a link.
+type Snapshot struct {
+	URL       string    // URL of the archived copy
+	Original  string    // The archived link
+	Provider  string    // Name of the provider
+	Timestamp time.Time // When the link was archived, zero if unknown
+}
+
+// FallbackProvider finds archived copies of links.
+type FallbackProvider interface {
+	// Name returns the name of the provider.
+	Name() string
+
+	// Lookup returns the snapshot of the link, or ErrNoSnapshot.
+	Lookup(ctx context.Context, link string) (*Snapshot, error)
+}
+
+var (
+	_ FallbackProvider = (*WaybackProvider)(nil)
+	_ FallbackProvider = (*ArchiveTodayProvider)(nil)
+	_ FallbackProvider = (*GhostarchiveProvider)(nil)
+	_ FallbackProvider = (*TemplateProvider)(nil)
+)
+
+// DefaultFallback is used by MatchURLFallback.
+var DefaultFallback = &Fallback{
+	Providers: []FallbackProvider{
+		&WaybackProvider{},
+		&ArchiveTodayProvider{},
+		&GhostarchiveProvider{},
+	},
+}
+
+// Fallback replaces dead links with their archived copies.
+type Fallback struct {
+	// Providers are tried in order until a snapshot found.
+	Providers []FallbackProvider
+
+	// Client checks whether links are not found, DefaultClient is used if nil.
+	Client *Client
+
+	// Rules strips links matched from text, default rules are used if nil.
+	Rules *RuleSet
+}
+
+// FallbackResult is a link matched by Fallback.
+type FallbackResult struct {
+	URL      string    // The link, or the URL of the snapshot if the link is dead
+	Original string    // The link stripped
+	Snapshot *Snapshot // Nil if the link is alive or no snapshot found
+}
+
+// MatchURL extracts links from text, and replaces dead links with the
+// snapshot found by providers.
+func (f *Fallback) MatchURL(ctx context.Context, text string) []FallbackResult {
+	c := f.Client
+	if c == nil {
+		c = DefaultClient
+	}
+
+	results := []FallbackResult{}
+	for _, link := range f.Rules.MatchURL(text) {
+		result := FallbackResult{URL: link, Original: link}
+		if c.NotFound(ctx, link) {
+			if snapshot, err := f.Lookup(ctx, link); err == nil {
+				result.URL, result.Snapshot = snapshot.URL, snapshot
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// Lookup tries providers in order, and returns the first snapshot found.
+func (f *Fallback) Lookup(ctx context.Context, link string) (*Snapshot, error) {
+	var errs []string
+	for _, p := range f.Providers {
+		snapshot, err := p.Lookup(ctx, link)
+		if err == nil {
+			return snapshot, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(err, ErrNoSnapshot) {
+			errs = append(errs, p.Name()+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoSnapshot, strings.Join(errs, "; "))
+	}
+	return nil, ErrNoSnapshot
+}
+
+func clientOrDefault(c *Client) *Client {
+	if c == nil {
+		return DefaultClient
+	}
+	return c
+}
+
+// WaybackProvider finds snapshots using the availability API
+// of the Wayback Machine.
+type WaybackProvider struct {
+	// Client sends requests, DefaultClient is used if nil.
+	Client *Client
+
+	// Endpoint defaults to https://archive.org/wayback/available.
+	Endpoint string
+}
+
+// Name implements the FallbackProvider interface.
+func (p *WaybackProvider) Name() string { return "wayback" }
+
+// Lookup implements the FallbackProvider interface.
+func (p *WaybackProvider) Lookup(ctx context.Context, link string) (*Snapshot, error) {
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "https://archive.org/wayback/available"
+	}
+
+	c := clientOrDefault(p.Client)
+	resp, err := c.do(ctx, c.httpClient(), request(http.MethodGet, endpoint+"?url="+url.QueryEscape(link)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var body struct {
+		Snapshots struct {
+			Closest struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+				Timestamp string `json:"timestamp"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	closest := body.Snapshots.Closest
+	if !closest.Available || closest.URL == "" {
+		return nil, ErrNoSnapshot
+	}
+
+	ts, _ := time.Parse("20060102150405", closest.Timestamp)
+	return &Snapshot{
+		URL:       strings.Replace(closest.URL, "http://", "https://", 1),
+		Original:  link,
+		Provider:  p.Name(),
+		Timestamp: ts,
+	}, nil
+}
+
+// ArchiveTodayProvider finds the newest snapshot using the Memento
+// TimeGate of archive.today.
+type ArchiveTodayProvider struct {
+	// Client sends requests, DefaultClient is used if nil.
+	Client *Client
+
+	// Endpoint defaults to https://archive.ph.
+	Endpoint string
+}
+
+// Name implements the FallbackProvider interface.
+func (p *ArchiveTodayProvider) Name() string { return "archive.today" }
+
+// Lookup implements the FallbackProvider interface.
+func (p *ArchiveTodayProvider) Lookup(ctx context.Context, link string) (*Snapshot, error) {
+	endpoint := strings.TrimSuffix(p.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://archive.ph"
+	}
+
+	c := clientOrDefault(p.Client)
+	hc := *c.httpClient()
+	hc.CheckRedirect = noRedirect
+	resp, err := c.do(ctx, &hc, request(http.MethodGet, endpoint+"/timegate/"+link))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoSnapshot
+	}
+	if !isRedirect(resp.StatusCode) {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, err
+	}
+
+	ts, _ := http.ParseTime(resp.Header.Get("Memento-Datetime"))
+	return &Snapshot{
+		URL:       loc.String(),
+		Original:  link,
+		Provider:  p.Name(),
+		Timestamp: ts,
+	}, nil
+}
+
+var ghostarchiveRegexp = regexp.MustCompile(`href="(/archive/[A-Za-z0-9]+)"`)
+
+// GhostarchiveProvider finds snapshots by searching Ghostarchive.
+type GhostarchiveProvider struct {
+	// Client sends requests, DefaultClient is used if nil.
+	Client *Client
+
+	// Endpoint defaults to https://ghostarchive.org.
+	Endpoint string
+}
+
+// Name implements the FallbackProvider interface.
+func (p *GhostarchiveProvider) Name() string { return "ghostarchive" }
+
+// Lookup implements the FallbackProvider interface, the timestamp
+// of the snapshot is unknown.
+func (p *GhostarchiveProvider) Lookup(ctx context.Context, link string) (*Snapshot, error) {
+	endpoint := strings.TrimSuffix(p.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://ghostarchive.org"
+	}
+
+	c := clientOrDefault(p.Client)
+	resp, err := c.do(ctx, c.httpClient(), request(http.MethodGet, endpoint+"/search?term="+url.QueryEscape(link)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	if err != nil {
+		return nil, err
+	}
+	m := ghostarchiveRegexp.FindSubmatch(body)
+	if m == nil {
+		return nil, ErrNoSnapshot
+	}
+
+	return &Snapshot{
+		URL:      endpoint + string(m[1]),
+		Original: link,
+		Provider: p.Name(),
+	}, nil
+}
+
+// TemplateProvider builds the snapshot URL from a template, `{url}` in the
+// template is replaced with the link, and `{escaped_url}` with the escaped
+// link, e.g. `https://web.archive.org/web/{url}`.
+type TemplateProvider struct {
+	// ProviderName is returned by Name, defaults to "template".
+	ProviderName string
+
+	Template string
+
+	// Verify requests the snapshot URL and rejects it if not found.
+	Verify bool
+
+	// Client sends requests if Verify, DefaultClient is used if nil.
+	Client *Client
+}
+
+// Name implements the FallbackProvider interface.
+func (p *TemplateProvider) Name() string {
+	if p.ProviderName == "" {
+		return "template"
+	}
+	return p.ProviderName
+}
+
+// Lookup implements the FallbackProvider interface, the timestamp
+// of the snapshot is unknown.
+func (p *TemplateProvider) Lookup(ctx context.Context, link string) (*Snapshot, error) {
+	if p.Template == "" {
+		return nil, errors.New("missing template")
+	}
+
+	r := strings.NewReplacer("{url}", link, "{escaped_url}", url.QueryEscape(link))
+	snapshot := r.Replace(p.Template)
+	if p.Verify && clientOrDefault(p.Client).NotFound(ctx, snapshot) {
+		return nil, ErrNoSnapshot
+	}
+
+	return &Snapshot{
+		URL:      snapshot,
+		Original: link,
+		Provider: p.Name(),
+	}, nil
+}
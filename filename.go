@@ -0,0 +1,250 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kennygrant/sanitize"
+)
+
+// DefaultFileNameTemplate is the template of FileName.
+const DefaultFileNameTemplate = `{{.Time}}{{with .Host}}-{{.}}{{end}}{{with .Path}}-{{.}}{{end}}{{.Ext}}`
+
+// DefaultTimeLayout is the layout of the time in filenames.
+const DefaultTimeLayout = "2006-01-02-150405.000"
+
+// windowsReserved are the reserved device names of Windows.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// FileNamer generates filenames of webpages, the zero value
+// behaves as FileName.
+type FileNamer struct {
+	// Registrable uses the registrable domain of the link instead of
+	// its host, so that subdomains share the same prefix.
+	Registrable bool
+
+	// Template is a text/template of the filename, see FileNameData for
+	// the data. Slashes in the result separate subdirectories, e.g.
+	// `{{.Now.Format "2006/01/02"}}/{{.Host}}-{{slice .Hash 0 12}}{{.Ext}}`.
+	// Defaults to DefaultFileNameTemplate.
+	Template string
+
+	// TimeLayout is the layout of FileNameData.Time, defaults to
+	// DefaultTimeLayout.
+	TimeLayout string
+
+	// UTC formats the time in UTC instead of local time.
+	UTC bool
+
+	// MaxLength is the maximum length in bytes of each path element,
+	// longer elements are truncated keeping the extension. Defaults to
+	// 255, which is the limit of most filesystems, eCryptfs needs 143.
+	MaxLength int
+
+	// OS is the operating system whose reserved names are rejected,
+	// defaults to runtime.GOOS.
+	OS string
+}
+
+// FileNameSource is the webpage to name.
+type FileNameSource struct {
+	Link        string
+	ContentType string
+	Title       string
+	Content     []byte    // Content to hash if Hash is empty
+	Head        []byte    // First bytes of content to sniff, defaults to Content
+	Hash        string    // Hex digest of content
+	Time        time.Time // Defaults to now
+}
+
+// FileNameData is the data of FileNamer templates.
+type FileNameData struct {
+	Now   time.Time // Time of the webpage
+	Time  string    // Time formatted by TimeLayout
+	Host  string    // Host of the link with dots replaced by dashes
+	Path  string    // Slug of the first four words of the path
+	Title string    // Slug of the title
+	Hash  string    // Hex digest of content, SHA-256 if computed
+	Ext   string    // Extension with the leading dot
+}
+
+// Name returns filename from webpage's link and content type, it falls
+// back to the time and extension if the template fails.
+func (n *FileNamer) Name(link, contentType string) string {
+	return n.name(FileNameSource{Link: link, ContentType: contentType})
+}
+
+// NameSniff is like Name, but picks the extension by sniffing the first
+// bytes of the content, see SniffContentType.
+func (n *FileNamer) NameSniff(link, contentType string, head []byte) string {
+	if head == nil {
+		head = []byte{}
+	}
+	return n.name(FileNameSource{Link: link, ContentType: contentType, Head: head})
+}
+
+func (n *FileNamer) name(src FileNameSource) string {
+	src.Time = time.Now()
+	name, err := n.Make(src)
+	if err != nil {
+		data := n.data(src)
+		return data.Time + data.Ext
+	}
+	return name
+}
+
+// Make returns the filename of the webpage, it returns an error if the
+// template fails or the filename is invalid on the operating system.
+func (n *FileNamer) Make(src FileNameSource) (string, error) {
+	text := n.Template
+	if text == "" {
+		text = DefaultFileNameTemplate
+	}
+	tmpl, err := template.New("filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	data := n.data(src)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	max := n.MaxLength
+	if max <= 0 {
+		max = 255
+	}
+	elems := strings.Split(buf.String(), "/")
+	for i, elem := range elems {
+		ext := ""
+		if i == len(elems)-1 {
+			ext = data.Ext
+		}
+		elems[i] = truncate(elem, ext, max)
+		if err := n.validate(elems[i]); err != nil {
+			return "", err
+		}
+	}
+
+	return strings.Join(elems, "/"), nil
+}
+
+func (n *FileNamer) data(src FileNameSource) FileNameData {
+	now := src.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if n.UTC {
+		now = now.UTC()
+	}
+	layout := n.TimeLayout
+	if layout == "" {
+		layout = DefaultTimeLayout
+	}
+
+	data := FileNameData{
+		Now:   now,
+		Time:  now.Format(layout),
+		Title: strings.Trim(sanitize.BaseName(src.Title), "-"),
+		Hash:  src.Hash,
+	}
+	head := src.Head
+	if head == nil {
+		head = src.Content
+	}
+	if head != nil {
+		if len(head) > SniffLen {
+			head = head[:SniffLen]
+		}
+		data.Ext = extension(SniffContentType(head, src.ContentType))
+	} else {
+		data.Ext = extension(src.ContentType)
+	}
+	if data.Hash == "" && src.Content != nil {
+		sum := sha256.Sum256(src.Content)
+		data.Hash = hex.EncodeToString(sum[:])
+	}
+
+	u, err := url.ParseRequestURI(src.Link)
+	if err != nil || u.Scheme == "" || u.Hostname() == "" {
+		return data
+	}
+	host := u.Hostname()
+	if n.Registrable {
+		host = RegistrableDomain(host)
+	}
+	data.Host = strings.ReplaceAll(host, ".", "-")
+	if u.Path != "" && u.Path != "/" {
+		baseName := strings.TrimPrefix(sanitize.BaseName(u.Path), "-")
+		if parts := strings.Split(baseName, "-"); len(parts) > 4 {
+			baseName = strings.Join(parts[:4], "-")
+		}
+		data.Path = baseName
+	}
+
+	return data
+}
+
+// truncate truncates name to max bytes keeping ext and valid UTF-8.
+func truncate(name, ext string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	if !strings.HasSuffix(name, ext) || len(ext) >= max {
+		ext = ""
+	}
+	base := name[:max-len(ext)]
+	for len(base) > 0 && !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return base + ext
+}
+
+// validate reports whether the path element is invalid on the operating system.
+func (n *FileNamer) validate(elem string) error {
+	goos := n.OS
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	switch {
+	case elem == "" || elem == "." || elem == "..":
+		return fmt.Errorf("invalid filename element %q", elem)
+	case strings.ContainsRune(elem, 0):
+		return fmt.Errorf("filename element %q contains NUL", elem)
+	}
+	if goos != "windows" {
+		return nil
+	}
+	if i := strings.IndexAny(elem, `<>:"\|?*`); i >= 0 {
+		return fmt.Errorf("filename element %q contains reserved character %q", elem, elem[i])
+	}
+	if strings.HasSuffix(elem, ".") || strings.HasSuffix(elem, " ") {
+		return fmt.Errorf("filename element %q ends with a dot or space", elem)
+	}
+	base := strings.ToUpper(elem)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if windowsReserved[strings.TrimRight(base, " ")] {
+		return fmt.Errorf("filename element %q is a reserved name", elem)
+	}
+	return nil
+}
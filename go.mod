@@ -6,9 +6,9 @@ require (
 	github.com/fortytw2/leaktest v1.3.0
 	github.com/kennygrant/sanitize v1.2.4
 	github.com/mattn/go-isatty v0.0.18
+	golang.org/x/image v0.10.0
 	golang.org/x/net v0.9.0
-	golang.org/x/text v0.9.0
+	golang.org/x/sys v0.7.0
+	golang.org/x/text v0.11.0
 	mvdan.cc/xurls/v2 v2.4.0
 )
-
-require golang.org/x/sys v0.7.0 // indirect
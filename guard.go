@@ -0,0 +1,150 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when dialing an address blocked by Guard.
+var ErrBlockedAddress = errors.New("blocked address")
+
+// blockedCIDRs are the loopback, private, link-local, multicast and
+// reserved ranges, which include the metadata endpoints of cloud providers.
+var blockedCIDRs = mustParseCIDRs(
+	"0.0.0.0/8",       // "This" network
+	"10.0.0.0/8",      // Private
+	"100.64.0.0/10",   // Carrier-grade NAT, includes 100.100.100.200 of Alibaba Cloud
+	"127.0.0.0/8",     // Loopback
+	"169.254.0.0/16",  // Link-local, includes 169.254.169.254
+	"172.16.0.0/12",   // Private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // Documentation
+	"192.168.0.0/16",  // Private
+	"198.18.0.0/15",   // Benchmarking
+	"198.51.100.0/24", // Documentation
+	"203.0.113.0/24",  // Documentation
+	"224.0.0.0/4",     // Multicast
+	"240.0.0.0/4",     // Reserved and broadcast
+	"::/128",          // Unspecified
+	"::1/128",         // Loopback
+	"64:ff9b::/96",    // NAT64, may translate to private IPv4
+	"100::/64",        // Discard
+	"2001:db8::/32",   // Documentation
+	"fc00::/7",        // Unique local, includes fd00:ec2::254 of AWS
+	"fe80::/10",       // Link-local
+	"ff00::/8",        // Multicast
+)
+
+// DefaultGuard is the Guard of the transport used by DefaultClient.
+var DefaultGuard = &Guard{}
+
+// Guard guards outbound connections against SSRF, it checks the address
+// of every connection when dialing, so redirects and DNS rebinding can
+// not reach blocked addresses.
+type Guard struct {
+	// Allow lists the ranges allowed even if blocked by default.
+	Allow []*net.IPNet
+
+	// Deny lists the ranges blocked in addition to the defaults,
+	// it takes precedence over Allow.
+	Deny []*net.IPNet
+
+	// Timeout is the dial timeout, defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+// ParseCIDRs parses CIDR notations, e.g. "10.0.0.0/8", to IP networks.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// Blocked reports whether the IP is blocked.
+func (g *Guard) Blocked(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	switch {
+	case containsIP(g.Deny, ip):
+		return true
+	case containsIP(g.Allow, ip):
+		return false
+	}
+	return containsIP(blockedCIDRs, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dialer returns a net.Dialer that refuses to connect to blocked addresses.
+func (g *Guard) Dialer() *net.Dialer {
+	timeout := g.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   g.control,
+	}
+}
+
+// DialContext connects to the address unless it is blocked.
+func (g *Guard) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return g.Dialer().DialContext(ctx, network, address)
+}
+
+// Transport returns an http.Transport dialing with the Guard. Proxies are
+// not used, as the Guard could not check the addresses behind them.
+func (g *Guard) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:           g.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// control is called after resolving and before connecting.
+func (g *Guard) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || g.Blocked(ip) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, address)
+	}
+	return nil
+}
@@ -5,17 +5,32 @@
 package helper // import "github.com/wabarc/helper"
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestStrip(t *testing.T) {
@@ -35,6 +50,51 @@ func TestStrip(t *testing.T) {
 	}
 }
 
+func TestRuleSet(t *testing.T) {
+	rules := `[
+		{"match": "prefix", "param": "ref_"},
+		{"host": "example.org", "param": "Token"},
+		{"host": "example.net", "match": "regex", "param": "s[0-9]+"}
+	]`
+	file := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(file, []byte(rules), 0644); err != nil {
+		t.Fatalf("Unexpected write file: %v", err)
+	}
+	rs, err := LoadRuleSet(file, true)
+	if err != nil {
+		t.Fatalf("Unexpected load rules: %v", err)
+	}
+
+	var tests = []struct {
+		link     string
+		expected string
+	}{
+		{"https://example.com/?ref_src=tw&id=1", "https://example.com/?id=1"},
+		{"https://example.com/?gclid=abc&mc_eid=1", "https://example.com/"},
+		{"https://www.example.org/?token=abc&id=1", "https://www.example.org/?id=1"},
+		{"https://example.com/?token=abc", "https://example.com/?token=abc"},
+		{"https://example.net/?s1=a&s=b&s12x=c", "https://example.net/?s=b&s12x=c"},
+		{"https://www.bilibili.com/video/BV1?share_source=copy&share_medium=ipad&p=2", "https://www.bilibili.com/video/BV1?p=2"},
+		{"https://twitter.com/wabarc/status/1?s=20&t=abc", "https://twitter.com/wabarc/status/1"},
+		{"https://example.com/?s=20", "https://example.com/?s=20"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			if got := rs.Strip(test.link); got != test.expected {
+				t.Errorf("Unexpected strip, got %s instead of %s", got, test.expected)
+			}
+		})
+	}
+
+	if _, err := NewRuleSet(Rule{Match: "glob", Param: "foo"}); err == nil {
+		t.Errorf("Unexpected new rule set with unknown match mode")
+	}
+	if got := rs.MatchURL("foo https://example.org/?token=1 bar"); len(got) != 1 || got[0] != "https://example.org/" {
+		t.Errorf("Unexpected match URL, got %v", got)
+	}
+}
+
 func TestMatchURL(t *testing.T) {
 	var tests = []struct {
 		name     string
@@ -71,41 +131,265 @@ func TestMatchURL(t *testing.T) {
 	}
 }
 
-func TestMatchURLFallback(t *testing.T) {
+func TestExtractor(t *testing.T) {
+	text := "see https://example.org/?utm_source=x&id=1 and\nexample.com/path, mail admin@example.net\n" +
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a or ftp://example.org/file"
+
 	var tests = []struct {
 		name     string
-		text     string
-		expected string
+		ext      *Extractor
+		expected []URLMatch
 	}{
 		{
-			name:     "Match Path",
-			text:     "foo bar https://example.org/せかい zoo",
-			expected: "https://webcache.googleusercontent.com/search?q=cache:https://example.org/%E3%81%9B%E3%81%8B%E3%81%84",
+			name: "strict",
+			ext:  &Extractor{},
+			expected: []URLMatch{
+				{Original: "https://example.org/?utm_source=x&id=1", URL: "https://example.org/?id=1", Start: 4, End: 42, Line: 1, Kind: KindStrict},
+				{Original: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", URL: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", Start: 88, End: 148, Line: 3, Kind: KindMagnet},
+				{Original: "ftp://example.org/file", URL: "ftp://example.org/file", Start: 152, End: 174, Line: 3, Kind: KindStrict},
+			},
 		},
 		{
-			name:     "Match and Use Google Cache",
-			text:     "foo bar https://example.org/404 zoo",
-			expected: "https://webcache.googleusercontent.com/search?q=cache:https://example.org/404",
+			name: "relaxed https and mailto",
+			ext:  &Extractor{Relaxed: true, Schemes: []string{"https", "mailto"}},
+			expected: []URLMatch{
+				{Original: "https://example.org/?utm_source=x&id=1", URL: "https://example.org/?id=1", Start: 4, End: 42, Line: 1, Kind: KindStrict},
+				{Original: "example.com/path", URL: "https://example.com/path", Start: 47, End: 63, Line: 2, Kind: KindRelaxed},
+				{Original: "admin@example.net", URL: "mailto:admin@example.net", Start: 70, End: 87, Line: 2, Kind: KindEmail},
+			},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			matched := MatchURLFallback(test.text)
-			if len(matched) == 0 {
-				t.Fatalf("Unexpected match URL number, got %d instead of 0", len(matched))
+			got := test.ext.Extract(text)
+			if len(got) != len(test.expected) {
+				t.Fatalf("Unexpected extract number, got %d instead of %d: %+v", len(got), len(test.expected), got)
 			}
-			if matched[0] != test.expected {
-				t.Errorf("Unexpected match URL, got %s instead of [%s]", matched, test.expected)
+			for i := range got {
+				if got[i] != test.expected[i] {
+					t.Errorf("Unexpected extract, got %+v instead of %+v", got[i], test.expected[i])
+				}
+				if text[got[i].Start:got[i].End] != got[i].Original {
+					t.Errorf("Unexpected offsets of %s", got[i].Original)
+				}
 			}
 		})
 	}
 }
 
+func urls(matches []URLMatch) []string {
+	links := []string{}
+	for _, m := range matches {
+		links = append(links, m.URL)
+	}
+	return links
+}
+
+func TestExtractHTML(t *testing.T) {
+	doc := `<html><head><base href="/blog/"><link rel="stylesheet" href="style.css"></head>
+<body><a href="post?utm_source=x&amp;id=1">https://example.org/ignored</a>
+<img src="a.png" srcset="a-2x.png 2x, https://cdn.example.org/a-3x.png 3x">
+<a href="javascript:void(0)">js</a><a href="#top">top</a>
+<p>Visit https://example.net/?a=1&amp;b=2 now</p><script>var u = "https://example.com/js";</script></body></html>`
+
+	base, _ := url.Parse("https://example.org/index.html")
+	matches, err := (&Extractor{}).ExtractHTML(strings.NewReader(doc), base)
+	if err != nil {
+		t.Fatalf("Unexpected extract HTML: %v", err)
+	}
+
+	expected := []string{
+		"https://example.org/blog/style.css",
+		"https://example.org/blog/post?id=1",
+		"https://example.org/blog/a.png",
+		"https://example.org/blog/a-2x.png",
+		"https://cdn.example.org/a-3x.png",
+		"https://example.net/?a=1&b=2",
+	}
+	if got := urls(matches); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Unexpected extract HTML, got %v instead of %v", got, expected)
+	}
+	if m := matches[2]; doc[m.Start:m.End] != "a.png" || m.Line != 3 {
+		t.Errorf("Unexpected position of %s: %d-%d line %d", m.Original, m.Start, m.End, m.Line)
+	}
+}
+
+func TestExtractMarkdown(t *testing.T) {
+	text := "Read [the post](https://en.wikipedia.org/wiki/Go_(language)?utm_source=x \"title\") and ![img](/a.png)\n" +
+		"<https://example.com/auto> or https://example.net/bare\n\n[ref]: <https://example.org/ref>"
+
+	base, _ := url.Parse("https://example.org/")
+	matches := (&Extractor{}).ExtractMarkdown(text, base)
+	expected := []string{
+		"https://en.wikipedia.org/wiki/Go_(language)",
+		"https://example.org/a.png",
+		"https://example.com/auto",
+		"https://example.net/bare",
+		"https://example.org/ref",
+	}
+	if got := urls(matches); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Unexpected extract Markdown, got %v instead of %v", got, expected)
+	}
+	if m := matches[4]; text[m.Start:m.End] != "https://example.org/ref" || m.Line != 4 {
+		t.Errorf("Unexpected position of %s: %d-%d line %d", m.Original, m.Start, m.End, m.Line)
+	}
+}
+
+func TestExtractFeed(t *testing.T) {
+	rss := `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0"><channel><link>https://example.org/</link>
+<item><link>https://example.org/post?fbclid=abc</link><guid isPermaLink="false">tag:1</guid>
+<enclosure url="https://example.org/a.mp3" type="audio/mpeg"/>
+<description><![CDATA[<p>See <a href="https://example.net/">this</a></p>]]></description></item>
+</channel></rss>`
+	atom := `<feed xmlns="http://www.w3.org/2005/Atom" xml:base="https://example.com/blog/">
+<entry><link href="post-1"/><content type="html">&lt;img src="img.png"&gt;</content></entry></feed>`
+
+	var tests = []struct {
+		name     string
+		feed     string
+		expected []string
+	}{
+		{"rss", rss, []string{"https://example.org/", "https://example.org/post", "https://example.org/a.mp3", "https://example.net/"}},
+		{"atom", atom, []string{"https://example.com/blog/post-1", "https://example.com/blog/img.png"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := (&Extractor{}).ExtractFeed(strings.NewReader(test.feed), nil)
+			if err != nil {
+				t.Fatalf("Unexpected extract feed: %v", err)
+			}
+			if got := urls(matches); strings.Join(got, " ") != strings.Join(test.expected, " ") {
+				t.Errorf("Unexpected extract feed, got %v instead of %v", got, test.expected)
+			}
+		})
+	}
+
+	matches, _ := (&Extractor{}).ExtractFeed(strings.NewReader(rss), nil)
+	if m := matches[1]; rss[m.Start:m.End] != "https://example.org/post?fbclid=abc" || m.Line != 3 {
+		t.Errorf("Unexpected position of %s: %d-%d line %d", m.Original, m.Start, m.End, m.Line)
+	}
+}
+
+func TestExtractMessage(t *testing.T) {
+	text := "😀 example.org and link, mail a@example.com"
+	entities := []TelegramEntity{
+		{Type: "url", Offset: 3, Length: 11},
+		{Type: "text_link", Offset: 19, Length: 4, URL: "https://example.net/?utm_source=tg"},
+		{Type: "email", Offset: 30, Length: 13},
+		{Type: "bold", Offset: 0, Length: 2},
+	}
+	matches := (&Extractor{}).ExtractTelegram(text, entities)
+	expected := []string{"https://example.org", "https://example.net/", "mailto:a@example.com"}
+	if got := urls(matches); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Unexpected extract Telegram, got %v instead of %v", got, expected)
+	}
+	if m := matches[1]; text[m.Start:m.End] != "link" || m.Original != "link" {
+		t.Errorf("Unexpected text link: %+v", m)
+	}
+
+	slack := "<@U123> see <https://example.org/?a=1&amp;b=2|the page> and <mailto:a@example.com|a>"
+	matches = (&Extractor{}).ExtractSlack(slack)
+	expected = []string{"https://example.org/?a=1&b=2", "mailto:a@example.com"}
+	if got := urls(matches); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Unexpected extract Slack, got %v instead of %v", got, expected)
+	}
+}
+
+func TestMatchURLFallback(t *testing.T) {
+	httpClient, mux, server := MockServer()
+	defer server.Close()
+
+	mux.HandleFunc("/alive", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello, World.")
+	})
+	mux.HandleFunc("/wayback/available", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") != "https://example.org/wayback" {
+			fmt.Fprintf(w, `{"archived_snapshots":{}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"archived_snapshots":{"closest":{"status":"200","available":true,`+
+			`"url":"http://web.archive.org/web/20230102030405/https://example.org/wayback","timestamp":"20230102030405"}}}`)
+	})
+	// ServeMux cleans the path of TimeGate, handles it without mux.
+	timegate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/timegate/https://example.org/archive-today" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Memento-Datetime", "Mon, 02 Jan 2023 03:04:05 GMT")
+		http.Redirect(w, r, "https://archive.ph/AbCdE", http.StatusFound)
+	}))
+	defer timegate.Close()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("term") != "https://example.org/ghost" {
+			fmt.Fprintf(w, "No results")
+			return
+		}
+		fmt.Fprintf(w, `<a href="/archive/AbCdE">https://example.org/ghost</a>`)
+	})
+
+	c := &Client{HTTPClient: httpClient}
+	f := &Fallback{
+		Client: c,
+		Providers: []FallbackProvider{
+			&WaybackProvider{Client: c, Endpoint: "https://archive.org/wayback/available"},
+			&ArchiveTodayProvider{Client: &Client{}, Endpoint: timegate.URL},
+			&GhostarchiveProvider{Client: c},
+			&TemplateProvider{ProviderName: "custom", Template: "https://example.com/web/{url}"},
+		},
+	}
+
+	var tests = []struct {
+		text     string
+		expected string
+		provider string
+	}{
+		{"foo https://example.org/alive?utm_source=wabarc bar", server.URL + "/alive", ""},
+		{"foo https://example.org/wayback bar", "https://web.archive.org/web/20230102030405/https://example.org/wayback", "wayback"},
+		{"foo https://example.org/archive-today bar", "https://archive.ph/AbCdE", "archive.today"},
+		{"foo https://example.org/ghost bar", "https://ghostarchive.org/archive/AbCdE", "ghostarchive"},
+		{"foo https://example.org/none bar", "https://example.com/web/https://example.org/none", "custom"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.provider, func(t *testing.T) {
+			text := strings.ReplaceAll(test.text, "https://example.org/alive", server.URL+"/alive")
+			results := f.MatchURL(context.Background(), text)
+			if len(results) != 1 {
+				t.Fatalf("Unexpected match URL number, got %d instead of 1", len(results))
+			}
+			if results[0].URL != test.expected {
+				t.Errorf("Unexpected match URL, got %s instead of %s", results[0].URL, test.expected)
+			}
+			if test.provider == "" {
+				if results[0].Snapshot != nil {
+					t.Errorf("Unexpected snapshot of alive link: %+v", results[0].Snapshot)
+				}
+				return
+			}
+			if results[0].Snapshot == nil || results[0].Snapshot.Provider != test.provider {
+				t.Fatalf("Unexpected snapshot: %+v", results[0].Snapshot)
+			}
+			if test.provider == "wayback" && results[0].Snapshot.Timestamp.Year() != 2023 {
+				t.Errorf("Unexpected snapshot timestamp: %s", results[0].Snapshot.Timestamp)
+			}
+		})
+	}
+
+	f.Providers = f.Providers[:3]
+	if _, err := f.Lookup(context.Background(), "https://example.org/none"); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("Unexpected lookup error, got %v instead of %v", err, ErrNoSnapshot)
+	}
+}
+
 func TestIsURL(t *testing.T) {
 	allow := []string{
 		"http://example.org",
 		"https://example.org:443",
+		"https://r3---sn-4g5e6nsz.googlevideo.com/videoplayback",
+		"https://my_host.example.com/",
 	}
 	deny := []string{
 		"",
@@ -115,6 +399,11 @@ func TestIsURL(t *testing.T) {
 		"/testing-path",
 		"testing-path",
 		"alskjff#?asf//dfas",
+		"javascript:alert.x",
+		"http://a.",
+		"http://a..b",
+		"http://exa mple.com",
+		"https://example.org:99999",
 	}
 	for _, u := range allow {
 		if !IsURL(u) {
@@ -130,6 +419,82 @@ func TestIsURL(t *testing.T) {
 	}
 }
 
+func TestValidator(t *testing.T) {
+	var tests = []struct {
+		name     string
+		v        *Validator
+		str      string
+		expected string
+		reason   string
+		warned   bool
+	}{
+		{"idn", &Validator{}, "https://bücher.example/path", "https://xn--bcher-kva.example/path", "", false},
+		{"trailing dot", &Validator{}, "https://example.org./", "https://example.org/", "", false},
+		{"ip", &Validator{}, "http://127.0.0.1:8080/", "http://127.0.0.1:8080/", "", false},
+		{"scheme", &Validator{Schemes: []string{"https"}}, "ftp://example.org/", "", "scheme ftp not allowed", false},
+		{"opaque", &Validator{}, "javascript:alert.x", "", "missing host", false},
+		{"public suffix", &Validator{PublicSuffix: true}, "https://example.invalidtld/", "", "unknown public suffix invalidtld", false},
+		{"suffix only", &Validator{PublicSuffix: true}, "https://co.uk/", "", "host co.uk is a public suffix", false},
+		{"registrable", &Validator{PublicSuffix: true}, "https://news.bbc.co.uk/", "https://news.bbc.co.uk/", "", false},
+		{"cyrillic", &Validator{}, "https://аррӏе.com/", "https://xn--80ak6aa92e.com/", "", true},
+		{"mixed", &Validator{}, "https://pаypal.com/", "https://xn--pypal-4ve.com/", "", true},
+		{"cjk", &Validator{}, "https://日本語ドメイン.jp/", "https://xn--eckwd4c7c5976acvb2w6i.jp/", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			valid, err := test.v.Validate(test.str)
+			if test.reason != "" {
+				var urlErr *URLError
+				if !errors.As(err, &urlErr) || urlErr.Reason != test.reason {
+					t.Fatalf("Unexpected validate error, got %v instead of reason %s", err, test.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected validate: %v", err)
+			}
+			if valid.URL != test.expected {
+				t.Errorf("Unexpected valid URL, got %s instead of %s", valid.URL, test.expected)
+			}
+			if warned := len(valid.Warnings) > 0; warned != test.warned {
+				t.Errorf("Unexpected warnings: %v", valid.Warnings)
+			}
+		})
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	var tests = []struct {
+		link     string
+		level    NormalizeLevel
+		expected string
+	}{
+		{"HTTP://User@Example.COM:80", NormalizeSafe, "http://User@example.com/"},
+		{"https://example.com:443/a/./b/../c/%7euser/%e4%b8%96?q=%2f#Top", NormalizeSafe, "https://example.com/a/c/~user/%E4%B8%96?q=%2F#Top"},
+		{"https://example.com:8443/?", NormalizeSafe, "https://example.com:8443/?"},
+		{"https://example.com./path?#frag", NormalizeUsuallySafe, "https://example.com/path"},
+		{"https://www.example.com//a//index.html?b=2&a=1&c=3#x", NormalizeAggressive, "https://example.com/a/?a=1&b=2&c=3"},
+		{"http://[::1]:80/", NormalizeSafe, "http://[::1]/"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			got, err := NormalizeURL(test.link, test.level)
+			if err != nil {
+				t.Fatalf("Unexpected normalize URL: %v", err)
+			}
+			if got != test.expected {
+				t.Errorf("Unexpected normalize URL, got %s instead of %s", got, test.expected)
+			}
+		})
+	}
+
+	if _, err := NormalizeURL("/relative/path", NormalizeSafe); err == nil {
+		t.Errorf("Unexpected normalize relative URL")
+	}
+}
+
 func TestFileName(t *testing.T) {
 	t.Parallel()
 
@@ -176,6 +541,181 @@ func TestFileName(t *testing.T) {
 	}
 }
 
+func TestParseDomain(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		link string
+		want *Domain
+	}{
+		{
+			link: "https://www.news.bbc.co.uk/path",
+			want: &Domain{Host: "www.news.bbc.co.uk", Registrable: "bbc.co.uk", Subdomain: "www.news", Suffix: "co.uk", ICANN: true},
+		},
+		{
+			link: "Example.ORG.",
+			want: &Domain{Host: "example.org", Registrable: "example.org", Suffix: "org", ICANN: true},
+		},
+		{
+			link: "https://foo.github.io",
+			want: &Domain{Host: "foo.github.io", Registrable: "foo.github.io", Suffix: "github.io"},
+		},
+		{link: "https://127.0.0.1/"},
+		{link: "co.uk"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			got, err := ParseDomain(test.link)
+			if test.want == nil {
+				if err == nil {
+					t.Errorf("Unexpected parse domain of %s, got %+v instead of an error", test.link, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if *got != *test.want {
+				t.Errorf("Unexpected parse domain of %s, got %+v instead of %+v", test.link, got, test.want)
+			}
+		})
+	}
+
+	if got := RegistrableDomain("http://127.0.0.1:8080/"); got != "127.0.0.1" {
+		t.Errorf("Unexpected registrable domain, got %s instead of 127.0.0.1", got)
+	}
+
+	n := &FileNamer{Registrable: true}
+	if got := n.Name("https://www.news.bbc.co.uk/some-path", "text/html"); !strings.Contains(got, "-bbc-co-uk-some-path.") {
+		t.Errorf("Unexpected file name, got %s instead of contains -bbc-co-uk-some-path.", got)
+	}
+}
+
+func TestFileNamer(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2023, 4, 5, 6, 7, 8, 9e6, time.FixedZone("UTC+8", 8*3600))
+	src := FileNameSource{
+		Link:        "https://www.example.org/some-path",
+		ContentType: "image/png",
+		Title:       "Hello, World!",
+		Content:     []byte("content"),
+		Time:        now,
+	}
+	long := strings.Repeat("a", 300)
+
+	var tests = []struct {
+		namer *FileNamer
+		src   FileNameSource
+		want  string
+		err   bool
+	}{
+		{
+			namer: &FileNamer{},
+			src:   src,
+			want:  "2023-04-05-060708.009-www-example-org-some-path.png",
+		},
+		{
+			namer: &FileNamer{UTC: true, Registrable: true},
+			src:   src,
+			want:  "2023-04-04-220708.009-example-org-some-path.png",
+		},
+		{
+			namer: &FileNamer{Template: `{{.Now.Format "2006/01/02"}}/{{.Title}}-{{slice .Hash 0 12}}{{.Ext}}`},
+			src:   src,
+			want:  "2023/04/05/Hello-World-ed7002b439e9.png",
+		},
+		{
+			namer: &FileNamer{Template: "{{.Path}}{{.Ext}}", MaxLength: 143},
+			src:   FileNameSource{Link: "https://example.org/" + long, ContentType: "image/png"},
+			want:  strings.Repeat("a", 139) + ".png",
+		},
+		{
+			namer: &FileNamer{Template: "{{.Unknown}}"},
+			src:   src,
+			err:   true,
+		},
+		{
+			namer: &FileNamer{Template: "con{{.Ext}}", OS: "windows"},
+			src:   src,
+			err:   true,
+		},
+		{
+			namer: &FileNamer{Template: "con{{.Ext}}", OS: "linux"},
+			src:   src,
+			want:  "con.png",
+		},
+		{
+			namer: &FileNamer{Template: "a:b", OS: "windows"},
+			src:   src,
+			err:   true,
+		},
+		{
+			namer: &FileNamer{Template: "../{{.Ext}}"},
+			src:   src,
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.namer.Template, func(t *testing.T) {
+			got, err := test.namer.Make(test.src)
+			if test.err {
+				if err == nil {
+					t.Errorf("Unexpected make file name, got %s instead of an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("Unexpected make file name, got %s instead of %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	t.Parallel()
+
+	epub := append([]byte("PK\x03\x04"), make([]byte, 26)...)
+	epub = append(epub, "mimetypeapplication/epub+zip"...)
+
+	var tests = []struct {
+		name string
+		head []byte
+		ct   string
+		ext  string
+	}{
+		{name: "pdf as html", head: []byte("%PDF-1.7\n"), ct: "text/html", ext: ".pdf"},
+		{name: "warc", head: []byte("WARC/1.1\r\n"), ct: "application/octet-stream", ext: ".warc"},
+		{name: "webp", head: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), ct: "", ext: ".webp"},
+		{name: "avif", head: []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), ct: "", ext: ".avif"},
+		{name: "mp4", head: []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00"), ct: "", ext: ".mp4"},
+		{name: "zip", head: []byte("PK\x03\x04\x14\x00"), ct: "", ext: ".zip"},
+		{name: "epub", head: epub, ct: "application/zip", ext: ".epub"},
+		{name: "gzip", head: []byte("\x1f\x8b\x08\x00"), ct: "application/octet-stream", ext: ".gz"},
+		{name: "png", head: []byte("\x89PNG\r\n\x1a\n"), ct: "application/octet-stream", ext: ".png"},
+		{name: "html as octet-stream", head: []byte("<!DOCTYPE html><html>"), ct: "application/octet-stream", ext: ".html"},
+		{name: "html", head: []byte("<html>"), ct: "text/html; charset=UTF-8", ext: ".html"},
+		{name: "json", head: []byte(`{"k":"v"}`), ct: "application/json", ext: ".json"},
+		{name: "svg", head: []byte(`<?xml version="1.0"?><svg>`), ct: "image/svg+xml", ext: ".svg"},
+		{name: "jpeg", head: []byte("\xff\xd8\xff\xe0"), ct: "image/jpeg", ext: ".jpg"},
+		{name: "empty", head: []byte{}, ct: "text/html", ext: ".html"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := FileNameSniff("https://example.org/file", test.ct, test.head)
+			if !strings.HasSuffix(filename, "-example-org-file"+test.ext) {
+				t.Errorf("Unexpected file name of %s, got %s instead of has extension %s", test.name, filename, test.ext)
+			}
+		})
+	}
+}
+
 func TestFileSize(t *testing.T) {
 	tmpfile, err := ioutil.TempFile(".", "helper-testing")
 	if err != nil {
@@ -212,20 +752,111 @@ func TestRealURI(t *testing.T) {
 		t.Skip("Skip test in short mode.")
 	}
 
-	final := "https://example.com/"
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, final, http.StatusSeeOther)
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "/final", http.StatusSeeOther)
+		}
 	}))
 	defer ts.Close()
 
-	u, _ := url.Parse(ts.URL)
-	want := RealURI(u)
+	final := ts.URL + "/final"
+	u, _ := url.Parse(ts.URL + "/")
+	want := (&Client{}).RealURI(context.Background(), u)
 	if want == nil {
 		t.Fatalf("Failed to request real uri")
 	}
 	if want.String() != final {
 		t.Fatalf("Test get final URL failed, expect: %v got: %s", final, want.String())
 	}
+
+	// Loopback address is blocked by the default client.
+	if want := RealURI(u); want.String() != u.String() {
+		t.Fatalf("Unexpected request blocked address, got: %s", want.String())
+	}
+}
+
+func TestTraceRedirect(t *testing.T) {
+	httpClient, mux, server := MockServer()
+	defer server.Close()
+
+	mux.HandleFunc("/short", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		http.Redirect(w, r, "/refresh", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head><meta http-equiv="Refresh" content="0; URL='/interstitial'"></head></html>`)
+	})
+	mux.HandleFunc("/interstitial", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<body><a data-tracking-control-name="external_url_click" href="/final">continue</a></body>`)
+	})
+	mux.HandleFunc("/final", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "final")
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+
+	c := &Client{HTTPClient: httpClient}
+	ctx := context.Background()
+
+	chain, err := c.TraceRedirect(ctx, server.URL+"/short", 0)
+	if err != nil {
+		t.Fatalf("Unexpected trace redirect: %v", err)
+	}
+	if chain.Reason != StopFinal || len(chain.Hops) != 4 {
+		t.Fatalf("Unexpected redirect chain: %+v", chain)
+	}
+	kinds := []string{HopRedirect, HopMetaRefresh, HopInterstitial, ""}
+	for i, hop := range chain.Hops {
+		if hop.Kind != kinds[i] {
+			t.Errorf("Unexpected hop %d kind, got %q instead of %q", i, hop.Kind, kinds[i])
+		}
+	}
+	if chain.Hops[0].Method != http.MethodGet || chain.Hops[0].Status != http.StatusMovedPermanently {
+		t.Errorf("Unexpected first hop: %+v", chain.Hops[0])
+	}
+	if !strings.HasSuffix(chain.Final(), "/final") {
+		t.Errorf("Unexpected final URL: %s", chain.Final())
+	}
+
+	chain, _ = c.TraceRedirect(ctx, server.URL+"/loop", 0)
+	if chain.Reason != StopLoop {
+		t.Errorf("Unexpected stop reason, got %s instead of %s", chain.Reason, StopLoop)
+	}
+	chain, _ = c.TraceRedirect(ctx, server.URL+"/short", 2)
+	if chain.Reason != StopMaxHops || len(chain.Hops) != 2 {
+		t.Errorf("Unexpected stop reason, got %s instead of %s", chain.Reason, StopMaxHops)
+	}
+
+	wrapped := "https://l.facebook.com/l.php?u=" + url.QueryEscape(server.URL+"/final")
+	chain, _ = c.TraceRedirect(ctx, wrapped, 0)
+	if len(chain.Hops) != 2 || chain.Hops[0].Kind != HopInterstitial {
+		t.Errorf("Unexpected redirect chain: %+v", chain)
+	}
+
+	base, _ := url.Parse("http://example.com/x/")
+	for content, want := range map[string]string{
+		"0; url=":               "",
+		"0; URL = /next":        "http://example.com/next",
+		"0;url='next'":          "http://example.com/x/next",
+		"5; Url =\t\"/quoted\"": "http://example.com/quoted",
+		"0; /bare":              "http://example.com/bare",
+		"0":                     "",
+	} {
+		got := ""
+		if loc := refreshURL(content, base); loc != nil {
+			got = loc.String()
+		}
+		if got != want {
+			t.Errorf("Unexpected refresh URL of %q, got %q instead of %q", content, got, want)
+		}
+	}
 }
 
 func TestTinyURL(t *testing.T) {
@@ -240,6 +871,57 @@ func TestTinyURL(t *testing.T) {
 	}
 }
 
+func TestShortener(t *testing.T) {
+	httpClient, mux, server := MockServer()
+	defer server.Close()
+
+	mux.HandleFunc("/api-create.php", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "https://tinyurl.com/wabarc")
+	})
+
+	ctx := context.Background()
+	link := "https://example.org/archived"
+	var s Shortener = &TinyURLShortener{Client: &Client{HTTPClient: httpClient}}
+	if got, err := s.Shorten(ctx, link); err != nil || got != "https://tinyurl.com/wabarc" {
+		t.Errorf("Unexpected tinyurl shorten, got %s, %v", got, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "links.json")
+	local, err := NewLocalShortener("https://s.example.com", file)
+	if err != nil {
+		t.Fatalf("Unexpected new local shortener: %v", err)
+	}
+	short, err := local.Shorten(ctx, link)
+	if err != nil || !strings.HasPrefix(short, "https://s.example.com/") {
+		t.Fatalf("Unexpected local shorten, got %s, %v", short, err)
+	}
+	if again, _ := local.Shorten(ctx, link); again != short {
+		t.Errorf("Unexpected shorten same link, got %s instead of %s", again, short)
+	}
+	if _, err := local.Shorten(ctx, "not-a-link"); err == nil {
+		t.Errorf("Unexpected shorten invalid link")
+	}
+
+	reloaded, err := NewLocalShortener("https://s.example.com/", file)
+	if err != nil {
+		t.Fatalf("Unexpected reload local shortener: %v", err)
+	}
+	if got, ok := reloaded.Expand(short); !ok || got != link {
+		t.Errorf("Unexpected expand, got %s instead of %s", got, link)
+	}
+
+	rec := httptest.NewRecorder()
+	reloaded.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, strings.TrimPrefix(short, "https://s.example.com"), nil))
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != link {
+		t.Errorf("Unexpected redirect, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = httptest.NewRecorder()
+	reloaded.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status, got %d instead of 404", rec.Code)
+	}
+}
+
 func TestRandString(t *testing.T) {
 	got := RandString(36, "")
 	if got == "" || len(got) != 36 {
@@ -271,7 +953,7 @@ func TestMockServer(t *testing.T) {
 }
 
 func TestNotFound(t *testing.T) {
-	_, mux, server := MockServer()
+	httpClient, mux, server := MockServer()
 	defer server.Close()
 
 	var tests = []struct {
@@ -299,7 +981,7 @@ func TestNotFound(t *testing.T) {
 				fmt.Fprintf(w, "Hello, World.")
 			})
 
-			f := NotFound(server.URL + p)
+			f := (&Client{HTTPClient: httpClient}).NotFound(context.Background(), server.URL+p)
 			if f != test.expected {
 				t.Fatalf(`Unexpected check url status, got %v instead of %t`, f, test.expected)
 			}
@@ -307,6 +989,276 @@ func TestNotFound(t *testing.T) {
 	}
 }
 
+func TestClient(t *testing.T) {
+	httpClient, mux, server := MockServer()
+	defer server.Close()
+
+	var attempts int32
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("User-Agent") != "wabarc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/final", http.StatusFound)
+	})
+	mux.HandleFunc("/final", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "final")
+	})
+	mux.HandleFunc("/api-create.php", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") != "https://example.com/?a=1&b=2" {
+			fmt.Fprintf(w, "Error")
+			return
+		}
+		fmt.Fprintf(w, "https://tinyurl.com/wabarc")
+	})
+
+	c := &Client{HTTPClient: httpClient, UserAgent: "wabarc", Retries: 2, RetryWait: time.Millisecond}
+	ctx := context.Background()
+
+	if !c.NotFound(ctx, server.URL+"/flaky") {
+		t.Errorf("Unexpected not found, got false instead of true")
+	}
+	if atomic.LoadInt32(&attempts) != 3 {
+		t.Errorf("Unexpected attempts, got %d instead of 3", attempts)
+	}
+
+	u, _ := url.Parse(server.URL + "/redirect")
+	if got := c.RealURI(ctx, u); got.Path != "/final" {
+		t.Errorf("Unexpected real URI, got %s", got)
+	}
+
+	got, err := c.TinyURL(ctx, "https://example.com/?a=1&b=2")
+	if err != nil || got != "https://tinyurl.com/wabarc" {
+		t.Errorf("Unexpected tiny URL, got %s, %v", got, err)
+	}
+	if _, err := c.TinyURL(ctx, "https://example.com/"); err == nil {
+		t.Errorf("Unexpected tiny URL without error")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if !c.NotFound(ctx, server.URL+"/final") {
+		t.Errorf("Unexpected not found with canceled context")
+	}
+}
+
+func TestChecker(t *testing.T) {
+	httpClient, mux, server := MockServer()
+	defer server.Close()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "home")
+	})
+	mux.HandleFunc("/alive", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "alive")
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	mux.HandleFunc("/limited", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	mux.HandleFunc("/captcha", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, `<div class="g-recaptcha"></div>`)
+	})
+	mux.HandleFunc("/contact", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<form><div class="g-recaptcha"></div></form>`)
+	})
+	mux.HandleFunc("/mitigated", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cf-Mitigated", "challenge")
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/alive", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/deleted/post", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	tlsServer := httptest.NewTLSServer(http.NewServeMux())
+	defer tlsServer.Close()
+
+	ch := &Checker{
+		Client:       &Client{HTTPClient: httpClient, Timeout: 100 * time.Millisecond},
+		HostInterval: 10 * time.Millisecond,
+	}
+	links := map[string]string{
+		server.URL + "/alive":        LinkAlive,
+		server.URL + "/gone":         LinkGone,
+		server.URL + "/limited":      LinkBlocked,
+		server.URL + "/captcha":      LinkBlocked,
+		server.URL + "/contact":      LinkAlive,
+		server.URL + "/mitigated":    LinkBlocked,
+		server.URL + "/moved":        LinkRedirected,
+		server.URL + "/deleted/post": LinkSoft404,
+		server.URL + "/slow":         LinkTimeout,
+	}
+	var input []string
+	for link := range links {
+		input = append(input, link)
+	}
+
+	start := time.Now()
+	results := ch.Check(context.Background(), input)
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Unexpected host interval, checked in %s", elapsed)
+	}
+	for i, result := range results {
+		if result.URL != input[i] {
+			t.Fatalf("Unexpected result order, got %s instead of %s", result.URL, input[i])
+		}
+		if result.Status != links[result.URL] {
+			t.Errorf("Unexpected status of %s, got %s instead of %s (%v)", result.URL, result.Status, links[result.URL], result.Err)
+		}
+	}
+
+	ch = &Checker{Client: &Client{}}
+	if result := ch.CheckLink(context.Background(), tlsServer.URL); result.Status != LinkTLSFailure {
+		t.Errorf("Unexpected status, got %s instead of %s (%v)", result.Status, LinkTLSFailure, result.Err)
+	}
+	if got := classifyError(&net.DNSError{Err: "no such host", Name: "example.invalid"}); got != LinkDNSFailure {
+		t.Errorf("Unexpected status, got %s instead of %s", got, LinkDNSFailure)
+	}
+}
+
+func TestSoft404(t *testing.T) {
+	httpClient, mux, server := MockServer()
+	defer server.Close()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><title>Example</title><body>Sorry, the page does not exist: %s</body></html>", r.URL.Path)
+	})
+	mux.HandleFunc("/spa/", func(w http.ResponseWriter, r *http.Request) {
+		// Single-page apps serve the same shell for every path.
+		fmt.Fprintf(w, `<html><title>App</title><body><div id="root"></div><script src="/app.js"></script></body></html>`)
+	})
+	mux.HandleFunc("/wiki/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/wiki/HTTP_404" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		fmt.Fprintf(w, "<html><title>HTTP 404 – Wiki</title><body>The HTTP 404 status code indicates that the server cannot find the requested resource.</body></html>")
+	})
+	mux.HandleFunc("/strict/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/strict/article" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "<html><title>Article</title><body>Hello, World.</body></html>")
+	})
+	mux.HandleFunc("/phrase/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/phrase/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "<html><title>Page Not Found</title></html>")
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+
+	c := &Client{HTTPClient: httpClient, Soft404Threshold: 0.8}
+	ctx := context.Background()
+
+	var tests = []struct {
+		path string
+		min  float64
+		max  float64
+	}{
+		{"/soft/missing", 0.8, 1},
+		{"/strict/article", 0, 0.1},
+		{"/spa/status/1", 0, 0.5},
+		{"/wiki/HTTP_404", 0, 0.7},
+		{"/phrase/missing", 0.3, 0.5},
+		{"/gone", 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			score, err := c.Soft404(ctx, server.URL+test.path)
+			if err != nil {
+				t.Fatalf("Unexpected soft 404: %v", err)
+			}
+			if score < test.min || score > test.max {
+				t.Errorf("Unexpected soft 404 score, got %f instead of [%f, %f]", score, test.min, test.max)
+			}
+		})
+	}
+
+	if !c.NotFound(ctx, server.URL+"/soft/missing") {
+		t.Errorf("Unexpected not found of soft 404, got false instead of true")
+	}
+	for _, path := range []string{"/strict/article", "/spa/status/1", "/wiki/HTTP_404"} {
+		if c.NotFound(ctx, server.URL+path) {
+			t.Errorf("Unexpected not found of %s, got true instead of false", path)
+		}
+	}
+	if DefaultClient.Soft404Threshold != 0 {
+		t.Errorf("Unexpected soft 404 detection enabled by DefaultClient")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello, World.")
+	})
+	mux.HandleFunc("/rebind", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(server.URL, "127.0.0.1", "127.0.0.2", 1), http.StatusFound)
+	})
+
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "169.254.169.254", "::1", "fd00:ec2::254", "::ffff:192.168.1.1"} {
+		if !DefaultGuard.Blocked(net.ParseIP(addr)) {
+			t.Errorf("Unexpected address %s not blocked", addr)
+		}
+	}
+	if DefaultGuard.Blocked(net.ParseIP("93.184.216.34")) {
+		t.Errorf("Unexpected public address blocked")
+	}
+
+	if !NotFound(server.URL) {
+		t.Errorf("Unexpected default client request loopback address")
+	}
+	_, err := DefaultClient.HTTPClient.Get(server.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Unexpected error, got %v instead of %v", err, ErrBlockedAddress)
+	}
+
+	allow, err := ParseCIDRs("127.0.0.1/32")
+	if err != nil {
+		t.Fatalf("Unexpected parse CIDRs: %v", err)
+	}
+	g := &Guard{Allow: allow}
+	c := &http.Client{Transport: g.Transport()}
+	resp, err := c.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected request allowed address: %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := c.Get(server.URL + "/rebind"); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Unexpected redirect to blocked address, got %v", err)
+	}
+
+	g = &Guard{Allow: allow, Deny: allow}
+	c = &http.Client{Transport: g.Transport()}
+	if _, err := c.Get(server.URL); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Unexpected request denied address, got %v", err)
+	}
+}
+
 func TestWritable(t *testing.T) {
 	t.Parallel()
 
@@ -451,31 +1403,270 @@ func TestMoveFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = os.Stat(dstfile)
+	_, err = os.Stat(dstfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := filepath.Join(dir, "other")
+	if err := os.WriteFile(other, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := MoveFile(other, dstfile); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Unexpected move to existing file, got %v instead of %v", err, os.ErrExist)
+	}
+	if err := (&Mover{Overwrite: true}).Move(other, dstfile); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(dstfile); string(got) != "other" || Exists(other) {
+		t.Errorf("Unexpected overwrite, got %q", got)
+	}
+
+	srcdir := filepath.Join(dir, "srcdir")
+	if err := os.MkdirAll(filepath.Join(srcdir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcdir, "sub", "file"), content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := MoveFile(srcdir, filepath.Join(dir, "dstdir")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "dstdir", "sub", "file")); string(got) != string(content) {
+		t.Errorf("Unexpected content of moved directory, got %q", got)
+	}
+}
+
+func TestMoverCopy(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "sub", "file")
+	if err := os.WriteFile(file, []byte("Hello, Golang!"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	accessed := time.Date(2019, 6, 7, 8, 9, 10, 0, time.UTC)
+	for _, path := range []string{file, filepath.Join(src, "sub"), src} {
+		if err := os.Chtimes(path, accessed, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := (&Mover{}).copyAll(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{".", "sub", filepath.Join("sub", "file")} {
+		want, _ := os.Stat(filepath.Join(src, rel))
+		got, err := os.Stat(filepath.Join(dst, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.ModTime().Equal(mtime) {
+			t.Errorf("Unexpected modification time of %s, got %v instead of %v", rel, got.ModTime(), mtime)
+		}
+		if (runtime.GOOS == "linux" || runtime.GOOS == "darwin") && !atime(got).Equal(accessed) {
+			t.Errorf("Unexpected access time of %s, got %v instead of %v", rel, atime(got), accessed)
+		}
+		if runtime.GOOS != "windows" && got.Mode() != want.Mode() {
+			t.Errorf("Unexpected mode of %s, got %v instead of %v", rel, got.Mode(), want.Mode())
+		}
+	}
+
+	if err := (&Mover{}).copyAll(src, dst); err == nil {
+		t.Errorf("Unexpected copy to existing destination")
+	}
+}
+
+func TestWebPToPNG(t *testing.T) {
+	src := "testdata/1.webp"
+	dst := filepath.Join(t.TempDir(), "1.png")
+
+	if err := WebPToPNG(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := png.Decode(f); err != nil {
+		t.Fatalf("Unexpected PNG: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WebPToPNGStream(&buf, strings.NewReader("RIFF\x00\x00\x00\x00WEBPVP8 ")); err == nil {
+		t.Errorf("Unexpected conversion of invalid WebP")
+	}
+	animated := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00")
+	if !animatedWebP(animated) {
+		t.Errorf("Unexpected animation flag of WebP")
+	}
+}
+
+func TestConverter(t *testing.T) {
+	t.Parallel()
+
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x * y), 255})
+		}
+	}
+	var src bytes.Buffer
+	if err := png.Encode(&src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	// JPEG with the EXIF orientation rotating 90 degrees clockwise.
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	rotated := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, byte(len(exif) + 2)}, exif...)
+	rotated = append(rotated, jpg.Bytes()[2:]...)
+
+	webpData, err := ioutil.ReadFile("testdata/1.webp")
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestWebPToPNG(t *testing.T) {
-	if _, err := exec.LookPath("dwebp"); err != nil {
-		t.Skip(err)
+	var tests = []struct {
+		name   string
+		conv   *Converter
+		src    []byte
+		format string
+		width  int
+		height int
+	}{
+		{name: "png to jpeg", conv: &Converter{Format: FormatJPEG}, src: src.Bytes(), format: FormatJPEG, width: 200, height: 100},
+		{name: "resize", conv: &Converter{MaxWidth: 50}, src: src.Bytes(), format: FormatPNG, width: 50, height: 25},
+		{name: "max bytes", conv: &Converter{Format: FormatJPEG, MaxBytes: 2000}, src: src.Bytes(), format: FormatJPEG},
+		{name: "gif", conv: &Converter{Format: FormatGIF, MaxHeight: 10}, src: src.Bytes(), format: FormatGIF, width: 20, height: 10},
+		{name: "orientation", conv: &Converter{}, src: rotated, format: FormatPNG, width: 100, height: 200},
+		{name: "webp", conv: &Converter{Format: FormatJPEG, MaxWidth: 100}, src: webpData, format: FormatJPEG, width: 100},
 	}
-	src := "testdata/1.webp"
-	dst := "testdata/1.png"
 
-	if err := WebPToPNG(src, dst); err != nil {
-		t.Fatal(err)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := test.conv.Convert(context.Background(), &out, bytes.NewReader(test.src)); err != nil {
+				t.Fatal(err)
+			}
+			if format := ImageFormat(out.Bytes()); format != test.format {
+				t.Errorf("Unexpected format, got %s instead of %s", format, test.format)
+			}
+			if test.conv.MaxBytes > 0 && out.Len() > test.conv.MaxBytes {
+				t.Errorf("Unexpected size, got %d bytes exceeds %d", out.Len(), test.conv.MaxBytes)
+			}
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(out.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (test.width > 0 && cfg.Width != test.width) || (test.height > 0 && cfg.Height != test.height) {
+				t.Errorf("Unexpected dimensions, got %dx%d instead of %dx%d", cfg.Width, cfg.Height, test.width, test.height)
+			}
+		})
 	}
 
-	if _, err := os.Stat(dst); os.IsNotExist(err) {
+	if err := (&Converter{}).Convert(context.Background(), ioutil.Discard, strings.NewReader("not an image")); err == nil {
+		t.Errorf("Unexpected conversion of unknown format")
+	}
+}
+
+type socksRequest struct {
+	user string
+	dest string
+}
+
+// fakeSOCKS5 starts a SOCKS5 server forwarding connections to backend,
+// and records the credentials and destinations of connections.
+func fakeSOCKS5(t *testing.T, backend string) (net.Listener, chan socksRequest) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
 		t.Fatal(err)
 	}
+	requests := make(chan socksRequest, 10)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		var req socksRequest
+		buf := make([]byte, 262)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 0x05 {
+			return
+		}
+		methods := buf[2 : 2+int(buf[1])]
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		if bytes.IndexByte(methods, 0x02) >= 0 {
+			conn.Write([]byte{0x05, 0x02})
+			// Username/password: version, ulen, user, plen, password.
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			user := make([]byte, buf[1])
+			io.ReadFull(conn, user)
+			io.ReadFull(conn, buf[:1])
+			io.ReadFull(conn, make([]byte, buf[0]))
+			req.user = string(user)
+			conn.Write([]byte{0x01, 0x00})
+		} else {
+			conn.Write([]byte{0x05, 0x00})
+		}
+
+		// Request: version, command, reserved, address type.
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+		var host string
+		switch buf[3] {
+		case 0x01:
+			io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 0x03:
+			io.ReadFull(conn, buf[:1])
+			name := make([]byte, buf[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+		io.ReadFull(conn, buf[:2])
+		req.dest = net.JoinHostPort(host, fmt.Sprint(int(buf[0])<<8|int(buf[1])))
+		requests <- req
+
+		upstream, err := net.Dial("tcp", backend)
+		if err != nil {
+			conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+
+	return ln, requests
 }
 
 func TestViaTor(t *testing.T) {
-	t.Parallel()
-
 	server := httptest.NewServer(http.NewServeMux())
 	defer server.Close()
 
@@ -483,39 +1674,123 @@ func TestViaTor(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	ln, _ := fakeSOCKS5(t, p.Host)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
 
 	var tests = []struct {
 		host string
 		port string
 
 		addr string
+		ok   bool
 	}{
 		{
-			host: "",
-			port: "",
-			addr: "127.0.0.1:9050",
+			host: host,
+			port: port,
+			addr: ln.Addr().String(),
+			ok:   true,
 		},
 		{
 			host: p.Hostname(),
 			port: p.Port(),
 			addr: p.Host,
+			ok:   false,
 		},
 	}
 
-	for _, test := range tests {
-		t.Run(test.addr, func(t *testing.T) {
-			os.Clearenv()
-			os.Setenv("TOR_HOST", test.host)
-			os.Setenv("TOR_SOCKS_PORT", test.port)
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Setenv("TOR_HOST", test.host)
+			t.Setenv("TOR_SOCKS_PORT", test.port)
 			addr, err := ViaTor()
-			if err != nil {
+			if test.ok && err != nil {
 				t.Fatal(err)
 			}
+			if !test.ok && !errors.Is(err, ErrNotSOCKS5) {
+				t.Errorf("Unexpected error, got %v instead of %v", err, ErrNotSOCKS5)
+			}
 			if addr != test.addr {
 				t.Errorf(`Unexpected via tor, got %s instead of %s`, addr, test.addr)
 			}
 		})
 	}
+
+	t.Setenv("TOR_HOST", "")
+	t.Setenv("TOR_SOCKS_PORT", "")
+	if addr := (&Tor{}).Addr(); addr != "127.0.0.1:9050" {
+		t.Errorf("Unexpected default address, got %s instead of 127.0.0.1:9050", addr)
+	}
+}
+
+func TestTor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	}))
+	defer server.Close()
+
+	ln, requests := fakeSOCKS5(t, strings.TrimPrefix(server.URL, "http://"))
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	tor := &Tor{Host: host, Port: port, Isolate: true}
+	if err := tor.Check(context.Background()); err != nil {
+		t.Fatalf("Unexpected check Tor: %v", err)
+	}
+
+	onion := "http://2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion/"
+	if !IsOnion("2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion:80") || IsOnion("example.com") {
+		t.Errorf("Unexpected onion hosts")
+	}
+	client := &http.Client{Transport: tor.Transport()}
+	fetch := func(ctx context.Context) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, onion, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected request through Tor: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.HasSuffix(string(body), ".onion") {
+			t.Errorf("Unexpected response: %s", body)
+		}
+	}
+	get := func(ctx context.Context) socksRequest {
+		fetch(ctx)
+		return <-requests
+	}
+
+	first, second := get(context.Background()), get(context.Background())
+	if first.dest != "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion:80" {
+		t.Errorf("Unexpected destination resolved locally: %s", first.dest)
+	}
+	if first.user == "" || first.user == second.user {
+		t.Errorf("Unexpected streams not isolated: %q and %q", first.user, second.user)
+	}
+
+	ctx := WithTorIsolation(context.Background(), "job-1")
+	if a, b := get(ctx), get(ctx); a.user != "job-1" || b.user != "job-1" {
+		t.Errorf("Unexpected isolation key, got %q and %q", a.user, b.user)
+	}
+
+	// Pooled connections must not be shared by different keys.
+	tor = &Tor{Host: host, Port: port}
+	client = &http.Client{Transport: tor.Transport()}
+	if a, b := get(WithTorIsolation(context.Background(), "job-A")), get(WithTorIsolation(context.Background(), "job-B")); a.user != "job-A" || b.user != "job-B" {
+		t.Errorf("Unexpected isolation keys, got %q and %q", a.user, b.user)
+	}
+	fetch(WithTorIsolation(context.Background(), "job-A"))
+	select {
+	case req := <-requests:
+		t.Errorf("Unexpected new stream of the same key: %+v", req)
+	default:
+	}
+
+	conn, err := (&Tor{Host: host, Port: port}).Dialer().Dial("tcp", "example.onion:443")
+	if err != nil {
+		t.Fatalf("Unexpected dial through Tor: %v", err)
+	}
+	conn.Close()
+	if req := <-requests; req.user != "" || req.dest != "example.onion:443" {
+		t.Errorf("Unexpected request without isolation: %+v", req)
+	}
 }
 
 func TestUnsetenv(t *testing.T) {
@@ -607,6 +1882,87 @@ func TestWriteFile(t *testing.T) {
 			}
 		})
 	}
+
+	if err := WriteFile(f, []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(f); string(got) != "short" {
+		t.Errorf(`Unexpected content of file, got %q instead of "short"`, got)
+	}
+}
+
+func TestAtomicWriter(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("Hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &AtomicWriter{Perm: 0644, PreservePerm: true, Append: true}
+	if err := w.WriteFile(path, []byte(", Golang!")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != "Hello, Golang!" {
+		t.Errorf(`Unexpected content of file, got %q instead of "Hello, Golang!"`, got)
+	}
+	if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected permission of file, got %v instead of 0600", info.Mode().Perm())
+	}
+
+	w = &AtomicWriter{Exclusive: true}
+	if err := w.WriteFile(path, []byte("data")); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Unexpected exclusive write of existing file, got %v instead of %v", err, os.ErrExist)
+	}
+	if err := w.WriteFile(filepath.Join(dir, "new"), []byte("data")); err != nil {
+		t.Errorf("Unexpected exclusive write of new file: %v", err)
+	}
+
+	f, err := (&AtomicWriter{}).Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("discarded"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != "Hello, Golang!" {
+		t.Errorf(`Unexpected content of file after discard, got %q`, got)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("Unexpected files left in directory, got %d instead of 2", len(entries))
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// Symbolic links are written through, including dangling ones.
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&AtomicWriter{}).WriteFile(link, []byte("through link")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Unexpected symbolic link replaced: %v", err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != "through link" {
+		t.Errorf("Unexpected content of link target, got %q", got)
+	}
+	dangling := filepath.Join(dir, "dangling")
+	if err := os.Symlink(filepath.Join(dir, "target"), dangling); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&AtomicWriter{}).WriteFile(dangling, []byte("created")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "target")); string(got) != "created" {
+		t.Errorf("Unexpected content of dangling link target, got %q", got)
+	}
 }
 
 func BenchmarkWriteFile(b *testing.B) {
@@ -628,6 +1984,142 @@ func BenchmarkWriteFile(b *testing.B) {
 	}
 }
 
+func TestCopier(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	content := strings.Repeat("Hello, Golang!", 100)
+
+	var progress int64
+	c := &Copier{Digest: DigestSHA1, BufferSize: 64, Progress: func(n int64) { progress = n }}
+	result, err := c.WriteFile(context.Background(), path, strings.NewReader(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != content {
+		t.Errorf("Unexpected content of file, got %d bytes instead of %d", len(got), len(content))
+	}
+	if result.Size != int64(len(content)) || progress != result.Size {
+		t.Errorf("Unexpected size, got %d and progress %d instead of %d", result.Size, progress, len(content))
+	}
+	sum := sha1.Sum([]byte(content))
+	if want := "sha1:" + base32.StdEncoding.EncodeToString(sum[:]); result.WARCDigest() != want {
+		t.Errorf("Unexpected digest, got %s instead of %s", result.WARCDigest(), want)
+	}
+
+	dst := filepath.Join(dir, "copy")
+	result, err = (&Copier{}).CopyFile(context.Background(), path, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256([]byte(content))); result.Hex() != want {
+		t.Errorf("Unexpected digest, got %s instead of %s", result.Hex(), want)
+	}
+
+	c = &Copier{MaxSize: 10}
+	if _, err := c.WriteFile(context.Background(), dst, strings.NewReader(content), 0644); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Unexpected error, got %v instead of %v", err, ErrTooLarge)
+	}
+	if got, _ := ioutil.ReadFile(dst); string(got) != content {
+		t.Errorf("Unexpected content of file after failed write, got %d bytes", len(got))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := WriteReader(ctx, filepath.Join(dir, "canceled"), strings.NewReader(content), 0644); !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected error, got %v instead of %v", err, context.Canceled)
+	}
+	if Exists(filepath.Join(dir, "canceled")) {
+		t.Errorf("Unexpected file of canceled write exists")
+	}
+}
+
+func mustPath(t *testing.T, s *Store, digest string) string {
+	t.Helper()
+	path, err := s.Path(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("Hello, Golang!")
+	digest, err := s.Put(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256(content)); digest != want {
+		t.Fatalf("Unexpected digest, got %s instead of %s", digest, want)
+	}
+	if want := filepath.Join(dir, "objects", digest[:2], digest[2:4], digest); mustPath(t, s, digest) != want {
+		t.Errorf("Unexpected path of blob, got %s instead of %s", mustPath(t, s, digest), want)
+	}
+	for _, bad := range []string{"..//../secret", "../" + digest[3:], strings.ToUpper(digest[:63]), ""} {
+		if path, err := s.Path(bad); err == nil {
+			t.Errorf("Unexpected path of invalid digest %q: %s", bad, path)
+		}
+		if s.Has(bad) {
+			t.Errorf("Unexpected blob of invalid digest %q", bad)
+		}
+		if f, err := s.Open(bad); err == nil {
+			f.Close()
+			t.Errorf("Unexpected open of invalid digest %q", bad)
+		}
+	}
+	if again, err := s.PutReader(context.Background(), strings.NewReader(string(content))); err != nil || again != digest {
+		t.Errorf("Unexpected put of the same content, got %s, %v", again, err)
+	}
+
+	for _, alias := range []string{"a.png", "2023/b.png"} {
+		path, err := s.Link(digest, alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadFile(path); string(got) != string(content) {
+			t.Errorf("Unexpected content of alias %s, got %q", alias, got)
+		}
+	}
+	if _, err := s.Link(digest, "../escape"); err == nil {
+		t.Errorf("Unexpected link of alias outside of store")
+	}
+	if n := s.Refs(digest); n != 2 {
+		t.Errorf("Unexpected references, got %d instead of 2", n)
+	}
+
+	s, err = NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := s.Resolve("2023/b.png"); !ok || d != digest {
+		t.Errorf("Unexpected resolve of alias after reopen, got %s", d)
+	}
+	if err := s.Unlink("a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := s.GC(0); err != nil || len(removed) != 0 {
+		t.Errorf("Unexpected garbage collection of referenced blob, got %v, %v", removed, err)
+	}
+	if err := s.Unlink("2023/b.png"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, _ := s.GC(time.Hour); len(removed) != 0 {
+		t.Errorf("Unexpected garbage collection of recent blob, got %v", removed)
+	}
+	if removed, err := s.GC(0); err != nil || len(removed) != 1 || s.Has(digest) {
+		t.Errorf("Unexpected garbage collection, got %v, %v", removed, err)
+	}
+}
+
 func TestRetryRemoveAll(t *testing.T) {
 	if os.Getuid() == 0 {
 		t.Skipf("Root can write to read-only files anyway, so skip the read-only test.")
@@ -665,6 +2157,171 @@ func TestRetryRemoveAll(t *testing.T) {
 	}
 }
 
+func TestTool(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script is not supported on Windows")
+	}
+
+	dir := t.TempDir()
+	script := `#!/bin/sh
+case "$1" in
+--version) echo "fake-tool version 1.2.3" ;;
+--fail) echo "something wrong" >&2; exit 3 ;;
+--sleep) exec sleep 5 ;;
+*) echo "$@" ;;
+esac
+`
+	bin := filepath.Join(dir, "fake-tool")
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tool := &Tool{Name: "fake-tool", Env: "FAKE_TOOL_BIN", VersionArgs: []string{"--version"}}
+	t.Setenv("FAKE_TOOL_BIN", "")
+	if _, err := tool.Path(); !errors.Is(err, ErrToolNotFound) {
+		t.Errorf("Unexpected lookup, got %v instead of %v", err, ErrToolNotFound)
+	}
+	t.Setenv("FAKE_TOOL_BIN", bin)
+	if path, err := tool.Path(); err != nil || path != bin {
+		t.Errorf("Unexpected lookup by env, got %s, %v", path, err)
+	}
+	t.Setenv("FAKE_TOOL_BIN", "")
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if path, err := tool.Path(); err != nil || path != bin {
+		t.Errorf("Unexpected lookup in PATH, got %s, %v", path, err)
+	}
+
+	ctx := context.Background()
+	if version, err := tool.Version(ctx); err != nil || version != "1.2.3" {
+		t.Errorf("Unexpected version, got %s, %v", version, err)
+	}
+	if out, err := tool.Run(ctx, "hello", "world"); err != nil || strings.TrimSpace(string(out)) != "hello world" {
+		t.Errorf("Unexpected output, got %q, %v", out, err)
+	}
+
+	var toolErr *ToolError
+	_, err := tool.Run(ctx, "--fail")
+	if !errors.As(err, &toolErr) || toolErr.ExitCode != 3 || toolErr.Stderr != "something wrong" {
+		t.Errorf("Unexpected error, got %#v", err)
+	}
+
+	tool.Timeout = 100 * time.Millisecond
+	if _, err := tool.Run(ctx, "--sleep"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Unexpected error, got %v instead of %v", err, context.DeadlineExceeded)
+	}
+
+	tool.MinVersion = "1.10"
+	if _, err := tool.Run(ctx, "hello"); err == nil {
+		t.Errorf("Unexpected run of tool older than the minimum version")
+	}
+
+	r := NewToolRegistry(tool)
+	if r.Lookup("fake-tool") != tool {
+		t.Errorf("Unexpected lookup of registered tool")
+	}
+	if r.Lookup("unknown-tool").Name != "unknown-tool" {
+		t.Errorf("Unexpected lookup of unknown tool")
+	}
+}
+
+func TestFindBrowsers(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("browser locations are tested on Linux")
+	}
+
+	fake := func(path, version string) string {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		script := "#!/bin/sh\necho \"Chromium " + version + "\"\n"
+		if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	dir := t.TempDir()
+	t.Setenv("PATH", filepath.Join(dir, "bin"))
+	t.Setenv("HOME", filepath.Join(dir, "home"))
+	t.Setenv("CHROME_BIN", "")
+	t.Setenv("PUPPETEER_CACHE_DIR", "")
+	t.Setenv("PLAYWRIGHT_BROWSERS_PATH", filepath.Join(dir, "playwright"))
+
+	browsers, err := FindBrowsers(context.Background())
+	for _, b := range browsers {
+		if strings.HasPrefix(b.Path, dir) {
+			t.Errorf("Unexpected browser found: %s", b.Path)
+		}
+	}
+	if len(browsers) == 0 && !errors.Is(err, ErrBrowserNotFound) {
+		t.Errorf("Unexpected error, got %v instead of %v", err, ErrBrowserNotFound)
+	}
+
+	chromium := fake(filepath.Join(dir, "bin", "chromium"), "120.0.6099.109")
+	brave := fake(filepath.Join(dir, "bin", "brave-browser"), "100.1.2")
+	old := fake(filepath.Join(dir, "playwright", "chromium-1000", "chrome-linux", "chrome"), "110.0.1")
+	latest := fake(filepath.Join(dir, "playwright", "chromium-1100", "chrome-linux", "chrome"), "121.0.1")
+	shell := fake(filepath.Join(dir, "home", ".cache", "puppeteer", "chrome-headless-shell", "linux-121.0.1", "chrome-headless-shell-linux64", "chrome-headless-shell"), "121.0.1")
+
+	browsers, err = FindBrowsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []Browser
+	for _, b := range browsers {
+		if strings.HasPrefix(b.Path, dir) {
+			found = append(found, b)
+		}
+	}
+	want := []Browser{
+		{Path: chromium, Kind: BrowserChromium, Source: SourceSystem, Version: "120.0.6099.109", Major: 120, HeadlessNew: true},
+		{Path: brave, Kind: BrowserBrave, Source: SourceSystem, Version: "100.1.2", Major: 100},
+		{Path: latest, Kind: BrowserChrome, Source: SourcePlaywright, Version: "121.0.1", Major: 121, HeadlessNew: true},
+		{Path: old, Kind: BrowserChrome, Source: SourcePlaywright, Version: "110.0.1", Major: 110, HeadlessNew: true},
+		{Path: shell, Kind: BrowserHeadlessShell, Source: SourcePuppeteer, Version: "121.0.1", Major: 121},
+	}
+	if len(found) != len(want) {
+		t.Fatalf("Unexpected browsers, got %+v instead of %+v", found, want)
+	}
+	for i := range want {
+		if found[i] != want[i] {
+			t.Errorf("Unexpected browser, got %+v instead of %+v", found[i], want[i])
+		}
+	}
+
+	// Browsers hanging on --version are given up.
+	hung := filepath.Join(dir, "hung", "chrome")
+	if err := os.MkdirAll(filepath.Dir(hung), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hung, []byte("#!/bin/sh\nPATH=/bin:/usr/bin exec sleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(timeout time.Duration) { browserVersionTimeout = timeout }(browserVersionTimeout)
+	browserVersionTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if b := inspectBrowser(context.Background(), hung, SourceEnv); b.Version != "" || time.Since(start) < browserVersionTimeout || time.Since(start) > 5*time.Second {
+		t.Errorf("Unexpected browser version probe, got %+v in %s", b, time.Since(start))
+	}
+
+	// Versions of installations on Windows.
+	install := filepath.Join(dir, "Application")
+	for _, name := range []string{"119.0.6045.200", "120.0.6099.109", "Locales"} {
+		if err := os.MkdirAll(filepath.Join(install, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(install, "121.0.6167.85.manifest"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if version := installedVersion(install); version != "121.0.6167.85" {
+		t.Errorf("Unexpected installed version, got %s instead of 121.0.6167.85", version)
+	}
+	if version := installedVersion(filepath.Join(dir, "missing")); version != "" {
+		t.Errorf("Unexpected installed version of missing directory: %s", version)
+	}
+}
+
 func TestFindChromeExecPath(t *testing.T) {
 	// Make sure the Chrome executable is not present.
 	if path := FindChromeExecPath(); path != "google-chrome" {
@@ -714,3 +2371,77 @@ func TestFindChromeExecPath(t *testing.T) {
 		})
 	}
 }
+
+func TestLauncher(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake browser requires sh")
+	}
+
+	dir := t.TempDir()
+	args := filepath.Join(dir, "args")
+	browser := filepath.Join(dir, "chromium")
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = \"--version\" ]; then echo \"Chromium 120.0.6099.109\"; exit 0; fi\n" +
+		"echo \"$@\" > " + args + "\n" +
+		"echo \"starting\" >&2\n" +
+		"echo \"DevTools listening on ws://127.0.0.1:9222/devtools/browser/abc\" >&2\n" +
+		"exec sleep 30\n"
+	if err := os.WriteFile(browser, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles := filepath.Join(dir, "profiles")
+	if err := os.Mkdir(profiles, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := &Launcher{Path: browser, Dir: profiles, Flags: []string{"--window-size=800,600"}, Timeout: 5 * time.Second}
+	p, err := l.Launch(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected launch browser: %v", err)
+	}
+	if p.WebSocketURL != "ws://127.0.0.1:9222/devtools/browser/abc" {
+		t.Errorf("Unexpected WebSocket URL: %s", p.WebSocketURL)
+	}
+	if p.Browser.Major != 120 || !p.Browser.HeadlessNew {
+		t.Errorf("Unexpected browser: %+v", p.Browser)
+	}
+	if filepath.Dir(p.ProfileDir) != profiles || !Exists(p.ProfileDir) {
+		t.Errorf("Unexpected profile directory: %s", p.ProfileDir)
+	}
+	data, err := os.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []string{"--headless=new", "--user-data-dir=" + p.ProfileDir, "--remote-debugging-port=0", "--window-size=800,600"} {
+		if !strings.Contains(string(data), arg) {
+			t.Errorf("Unexpected arguments, %s not found in %s", arg, data)
+		}
+	}
+
+	cancel()
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unexpected browser not closed after cancellation")
+	}
+	if Exists(p.ProfileDir) {
+		t.Errorf("Unexpected profile directory not removed: %s", p.ProfileDir)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Unexpected close browser: %v", err)
+	}
+
+	failing := filepath.Join(dir, "failing")
+	if err := os.WriteFile(failing, []byte("#!/bin/sh\necho \"cannot open display\" >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	l = &Launcher{Path: failing, Dir: profiles, Timeout: 5 * time.Second}
+	if _, err := l.Launch(context.Background()); err == nil || !strings.Contains(err.Error(), "cannot open display") {
+		t.Errorf("Unexpected error of failing browser: %v", err)
+	}
+	if entries, _ := os.ReadDir(profiles); len(entries) != 0 {
+		t.Errorf("Unexpected profiles not removed: %d", len(entries))
+	}
+}
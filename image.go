@@ -0,0 +1,398 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// Image formats of Converter.
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+	FormatAVIF = "avif"
+	FormatHEIC = "heic"
+)
+
+// imageDecoders are the external tools converting images to PNG, which
+// return the command line of the source and destination.
+var imageDecoders = map[string]func(src, dst string) []string{
+	FormatWebP: func(src, dst string) []string { return []string{"dwebp", src, "-o", dst} },
+	FormatAVIF: func(src, dst string) []string { return []string{"avifdec", src, dst} },
+	FormatHEIC: func(src, dst string) []string { return []string{"heif-convert", src, dst} },
+}
+
+// Converter converts images, the zero value converts to PNG. Sources
+// could be PNG, JPEG, GIF and WebP, and AVIF and HEIC if avifdec and
+// heif-convert are installed, only the first frame of animations is
+// converted. Metadata such as EXIF is stripped, and the EXIF orientation
+// of JPEG is applied.
+//
+// For example, to fit screenshots into the upload limit of Telegram:
+//
+//	c := &Converter{Format: FormatJPEG, MaxWidth: 2560, MaxHeight: 2560, MaxBytes: 10 << 20}
+type Converter struct {
+	// Format is the target format, one of FormatPNG, FormatJPEG,
+	// FormatGIF and FormatWebP, which requires cwebp. Defaults to PNG.
+	Format string
+
+	// MaxWidth and MaxHeight are the maximum dimensions, larger images
+	// are scaled down keeping the aspect ratio. 0 means no limit.
+	MaxWidth  int
+	MaxHeight int
+
+	// MaxBytes is the maximum size of the result, the quality of JPEG
+	// and WebP and then the dimensions are reduced to fit. 0 means no limit.
+	MaxBytes int
+
+	// Quality is the quality of JPEG and WebP from 1 to 100, defaults to 85.
+	Quality int
+}
+
+// ImageFormat returns the format of the image, or empty if unknown.
+func ImageFormat(data []byte) string {
+	if len(data) > SniffLen {
+		data = data[:SniffLen]
+	}
+	switch mediaType(SniffContentType(data, "")) {
+	case "image/png":
+		return FormatPNG
+	case "image/jpeg":
+		return FormatJPEG
+	case "image/gif":
+		return FormatGIF
+	case "image/webp":
+		return FormatWebP
+	case "image/avif":
+		return FormatAVIF
+	case "image/heic":
+		return FormatHEIC
+	}
+	return ""
+}
+
+// ConvertFile converts the image src to dst.
+func (c *Converter) ConvertFile(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := (&AtomicWriter{}).Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := c.Convert(ctx, f, in); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// Convert converts the image read from r and writes it to w.
+func (c *Converter) Convert(ctx context.Context, w io.Writer, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(ctx, data)
+	if err != nil {
+		return err
+	}
+	img = orient(img, exifOrientation(data))
+	img = scale(img, c.MaxWidth, c.MaxHeight)
+
+	quality := c.Quality
+	if quality <= 0 || quality > 100 {
+		quality = 85
+	}
+	for {
+		out, err := c.encode(ctx, img, quality)
+		if err != nil {
+			return err
+		}
+		if c.MaxBytes <= 0 || len(out) <= c.MaxBytes {
+			_, err = w.Write(out)
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		lossy := c.Format == FormatJPEG || c.Format == FormatWebP
+		if lossy && quality > 40 {
+			quality -= 15
+			continue
+		}
+		b := img.Bounds()
+		if b.Dx() <= 16 || b.Dy() <= 16 {
+			return fmt.Errorf("%w: image exceeds %d bytes", ErrTooLarge, c.MaxBytes)
+		}
+		img = scale(img, b.Dx()*3/4, b.Dy()*3/4)
+	}
+}
+
+func (c *Converter) encode(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	switch c.Format {
+	case "", FormatPNG:
+		err := png.Encode(&buf, img)
+		return buf.Bytes(), err
+	case FormatJPEG:
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		return buf.Bytes(), err
+	case FormatGIF:
+		err := gif.Encode(&buf, img, nil)
+		return buf.Bytes(), err
+	case FormatWebP:
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		return runImageTool(ctx, buf.Bytes(), ".png", ".webp", func(src, dst string) []string {
+			return []string{"cwebp", "-quiet", "-q", strconv.Itoa(quality), src, "-o", dst}
+		})
+	}
+	return nil, fmt.Errorf("unsupported image format: %s", c.Format)
+}
+
+// decodeImage decodes the image natively, or using external tools for the
+// formats not supported by Go.
+func decodeImage(ctx context.Context, data []byte) (image.Image, error) {
+	format := ImageFormat(data)
+	var err error
+	switch format {
+	case "":
+		return nil, errors.New("unknown image format")
+	case FormatPNG, FormatJPEG, FormatGIF:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		return img, err
+	case FormatWebP:
+		if !animatedWebP(data) {
+			img, derr := webp.Decode(bytes.NewReader(data))
+			if derr == nil {
+				return img, nil
+			}
+			err = derr
+		} else {
+			err = errors.New("webp: animation not supported")
+		}
+	}
+
+	out, terr := runImageTool(ctx, data, "."+format, ".png", imageDecoders[format])
+	if terr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("%v, fallback to %s: %w", err, imageDecoders[format]("", "")[0], terr)
+		}
+		return nil, terr
+	}
+	return png.Decode(bytes.NewReader(out))
+}
+
+// runImageTool runs the external tool converting the image in temporary files.
+func runImageTool(ctx context.Context, data []byte, srcExt, dstExt string, command func(src, dst string) []string) ([]byte, error) {
+	tool := LookupTool(command("", "")[0])
+	if _, err := tool.Path(); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "helper-image-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"+srcExt), filepath.Join(dir, "dst"+dstExt)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		return nil, err
+	}
+	if _, err := tool.Run(ctx, command(src, dst)[1:]...); err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(dst)
+}
+
+// scale scales the image down to fit the dimensions keeping the aspect
+// ratio, 0 means no limit.
+func scale(img image.Image, maxWidth, maxHeight int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if maxWidth > 0 && w > maxWidth {
+		w, h = maxWidth, h*maxWidth/w
+	}
+	if maxHeight > 0 && h > maxHeight {
+		w, h = w*maxHeight/h, maxHeight
+	}
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// exifOrientation returns the EXIF orientation of JPEG, or 1 if absent.
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker, size := data[i+1], int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || marker == 0xD9 || i+2+size > len(data) {
+			break
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return tiffOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) || ifd < 0 {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// orient transforms the image by the EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Flip horizontally
+				sx, sy = w-1-x, y
+			case 3: // Rotate 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // Flip vertically
+				sx, sy = x, h-1-y
+			case 5: // Transpose
+				sx, sy = y, x
+			case 6: // Rotate 90 clockwise
+				sx, sy = y, h-1-x
+			case 7: // Transverse
+				sx, sy = w-1-y, h-1-x
+			case 8: // Rotate 90 counterclockwise
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// WebPToPNG convert WebP to PNG
+func WebPToPNG(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := (&AtomicWriter{}).Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := WebPToPNGStream(f, in); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// WebPToPNGStream converts WebP read from r to PNG written to w. It decodes
+// WebP natively, and falls back to dwebp for the features not supported
+// by the Go decoder, such as animation.
+func WebPToPNGStream(w io.Writer, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if format := ImageFormat(data); format != FormatWebP {
+		return errors.New("webp: invalid format")
+	}
+
+	img, err := decodeImage(context.Background(), data)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// animatedWebP reports whether the WebP has the animation flag of the
+// extended format.
+func animatedWebP(data []byte) bool {
+	const animationBit = 1 << 1
+	return len(data) > 20 &&
+		string(data[0:4]) == "RIFF" && string(data[8:16]) == "WEBPVP8X" &&
+		data[20]&animationBit != 0
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var devToolsRegexp = regexp.MustCompile(`DevTools listening on (ws://\S+)`)
+
+// defaultBrowserFlags are the flags for headless browsers in servers
+// and containers.
+var defaultBrowserFlags = []string{
+	"--remote-debugging-port=0",
+	"--no-first-run",
+	"--no-default-browser-check",
+	"--disable-background-networking",
+	"--disable-background-timer-throttling",
+	"--disable-component-update",
+	"--disable-default-apps",
+	"--disable-dev-shm-usage",
+	"--disable-extensions",
+	"--disable-gpu",
+	"--disable-sync",
+	"--hide-scrollbars",
+	"--metrics-recording-only",
+	"--mute-audio",
+}
+
+// Launcher launches headless browsers with temporary profiles.
+type Launcher struct {
+	// Path is the path of the browser, defaults to the one found by FindBrowser.
+	Path string
+
+	// Dir is the directory of temporary profiles, defaults to os.TempDir().
+	Dir string
+
+	// Flags are the additional flags of the browser.
+	Flags []string
+
+	// NoSandbox disables the sandbox of the browser, it is always
+	// disabled when running as root, which the sandbox does not support.
+	NoSandbox bool
+
+	// Timeout is the timeout of waiting for the DevTools endpoint,
+	// defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+// BrowserProcess is a browser launched by Launcher.
+type BrowserProcess struct {
+	Browser      Browser // The browser launched
+	WebSocketURL string  // The DevTools WebSocket URL
+	ProfileDir   string  // The temporary profile
+
+	cmd    *exec.Cmd
+	stderr *stderrWriter
+	exited chan struct{}
+	closed chan struct{}
+	once   sync.Once
+	err    error // error of the process
+	rmErr  error // error of removing the profile
+}
+
+// Launch starts the browser and waits for its DevTools endpoint. The
+// browser is killed and its profile is removed when ctx is done or the
+// process is closed.
+func (l *Launcher) Launch(ctx context.Context) (*BrowserProcess, error) {
+	var b Browser
+	if l.Path == "" {
+		found, err := FindBrowser(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b = *found
+	} else {
+		path, err := exec.LookPath(l.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBrowserNotFound, err)
+		}
+		b = inspectBrowser(ctx, path, SourceEnv)
+	}
+
+	dir := l.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := Writable(dir); err != nil {
+		return nil, err
+	}
+	profile, err := ioutil.TempDir(dir, "helper-browser-")
+	if err != nil {
+		return nil, err
+	}
+
+	headless := "--headless"
+	if b.HeadlessNew {
+		headless = "--headless=new"
+	}
+	args := append([]string{headless, "--user-data-dir=" + profile}, defaultBrowserFlags...)
+	if l.NoSandbox || os.Geteuid() == 0 {
+		args = append(args, "--no-sandbox")
+	}
+	args = append(append(args, l.Flags...), "about:blank")
+
+	p := &BrowserProcess{
+		Browser:    b,
+		ProfileDir: profile,
+		cmd:        exec.Command(b.Path, args...),
+		stderr:     &stderrWriter{found: make(chan string, 1)},
+		exited:     make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	p.cmd.Stderr = p.stderr
+	setProcessGroup(p.cmd)
+	if err := p.cmd.Start(); err != nil {
+		RetryRemoveAll(profile, 5)
+		return nil, err
+	}
+	go func() {
+		p.err = p.cmd.Wait()
+		close(p.exited)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.exited:
+		}
+		p.Close()
+	}()
+
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case p.WebSocketURL = <-p.stderr.found:
+		return p, nil
+	case <-p.exited:
+		err = fmt.Errorf("browser exited: %v", p.err)
+	case <-timer.C:
+		err = errors.New("timeout waiting for DevTools endpoint")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	p.Close()
+	if tail := p.stderr.tail(); tail != "" {
+		err = fmt.Errorf("%w: %s", err, tail)
+	}
+
+	return nil, err
+}
+
+// Close kills the browser and removes its profile.
+func (p *BrowserProcess) Close() error {
+	p.once.Do(func() {
+		select {
+		case <-p.exited:
+		default:
+			killProcessGroup(p.cmd)
+			<-p.exited
+		}
+		p.rmErr = RetryRemoveAll(p.ProfileDir, 5)
+		close(p.closed)
+	})
+	<-p.closed
+
+	return p.rmErr
+}
+
+// Done returns a channel closed after the browser exits and its profile
+// is removed.
+func (p *BrowserProcess) Done() <-chan struct{} {
+	return p.closed
+}
+
+// stderrWriter finds the DevTools endpoint in stderr, and keeps its tail.
+type stderrWriter struct {
+	mu    sync.Mutex
+	buf   []byte
+	found chan string
+	sent  bool
+}
+
+func (w *stderrWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	if !w.sent {
+		if m := devToolsRegexp.FindSubmatch(w.buf); m != nil && bytes.Contains(w.buf[bytes.Index(w.buf, m[1]):], []byte("\n")) {
+			w.found <- string(m[1])
+			w.sent = true
+		}
+	}
+	if len(w.buf) > maxStderr {
+		w.buf = w.buf[len(w.buf)-maxStderr:]
+	}
+
+	return len(p), nil
+}
+
+func (w *stderrWriter) tail() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return string(bytes.TrimSpace(w.buf))
+}
@@ -0,0 +1,395 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// nonLinkSchemes are the schemes that never point to a resource to archive.
+var nonLinkSchemes = map[string]bool{
+	"javascript": true,
+	"data":       true,
+	"about":      true,
+	"blob":       true,
+}
+
+// htmlLinkAttrs are the attributes holding links of HTML elements.
+var htmlLinkAttrs = map[string][]string{
+	"a":          {"href"},
+	"area":       {"href"},
+	"link":       {"href"},
+	"img":        {"src", "srcset"},
+	"source":     {"src", "srcset"},
+	"iframe":     {"src"},
+	"embed":      {"src"},
+	"script":     {"src"},
+	"video":      {"src", "poster"},
+	"audio":      {"src"},
+	"track":      {"src"},
+	"object":     {"data"},
+	"blockquote": {"cite"},
+	"q":          {"cite"},
+}
+
+// resolve resolves the link found in markup against base, base could be nil.
+func (e *Extractor) resolve(raw string, base *url.URL) (URLMatch, bool) {
+	ref := strings.TrimSpace(raw)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return URLMatch{}, false
+	}
+	u, err := url.Parse(ref)
+	if err != nil || nonLinkSchemes[strings.ToLower(u.Scheme)] {
+		return URLMatch{}, false
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	return e.complete(raw, u.String(), "")
+}
+
+// ExtractHTML returns the links of HTML elements such as `<a href>` and
+// `<img src>` resolved against base, and the links in text outside of
+// anchors. The `<base href>` element overrides base.
+func (e *Extractor) ExtractHTML(r io.Reader, base *url.URL) ([]URLMatch, error) {
+	matches := []URLMatch{}
+	z := html.NewTokenizer(r)
+	offset, line := 0, 1
+	skip := 0
+	for {
+		tt := z.Next()
+		raw := z.Raw()
+		start, startLine := offset, line
+		offset += len(raw)
+		line += bytes.Count(raw, []byte("\n"))
+
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return matches, nil
+			}
+			return matches, z.Err()
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			for _, m := range e.Extract(string(raw)) {
+				if strings.Contains(m.Original, "&") {
+					unescaped, ok := e.match(html.UnescapeString(m.Original))
+					if !ok {
+						continue
+					}
+					m.URL = unescaped.URL
+				}
+				m.Start, m.End, m.Line = m.Start+start, m.End+start, m.Line+startLine-1
+				matches = append(matches, m)
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "a", "script", "style":
+				if skip > 0 {
+					skip--
+				}
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			if tt == html.StartTagToken && (tag == "a" || tag == "script" || tag == "style") {
+				skip++
+			}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if tag == "base" && string(key) == "href" {
+					if u, err := url.Parse(strings.TrimSpace(string(val))); err == nil {
+						if base != nil {
+							u = base.ResolveReference(u)
+						}
+						base = u
+					}
+					continue
+				}
+				if !contains(htmlLinkAttrs[tag], string(key)) {
+					continue
+				}
+				refs := []string{string(val)}
+				if string(key) == "srcset" {
+					refs = srcset(string(val))
+				}
+				for _, ref := range refs {
+					m, ok := e.resolve(ref, base)
+					if !ok {
+						continue
+					}
+					m.Start, m.End, m.Line = start, start+len(raw), startLine
+					if i := bytes.Index(raw, []byte(ref)); i >= 0 {
+						m.Start, m.End = start+i, start+i+len(ref)
+						m.Line += bytes.Count(raw[:i], []byte("\n"))
+					}
+					matches = append(matches, m)
+				}
+			}
+		}
+	}
+}
+
+// srcset returns the URLs of the srcset attribute.
+func srcset(val string) (refs []string) {
+	for _, candidate := range strings.Split(val, ",") {
+		if fields := strings.Fields(candidate); len(fields) > 0 {
+			refs = append(refs, fields[0])
+		}
+	}
+	return
+}
+
+var (
+	markdownInline = regexp.MustCompile(`\]\((<[^<>\n]*>|[^\s()<>]*(?:\([^\s()]*\)[^\s()]*)*)`)
+	markdownAuto   = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9+.\-]{1,31}:[^<>\s]*)>`)
+	markdownRef    = regexp.MustCompile(`(?m)^ {0,3}\[[^\]\n]+\]:[ \t]*(<[^<>\n]*>|\S+)`)
+)
+
+// ExtractMarkdown returns the links of Markdown, including inline links
+// and images, autolinks, reference definitions and bare links, relative
+// links are resolved against base. It also handles the masked links and
+// autolinks of Discord messages.
+func (e *Extractor) ExtractMarkdown(text string, base *url.URL) []URLMatch {
+	matches := []URLMatch{}
+	add := func(m URLMatch) {
+		for _, n := range matches {
+			if m.Start < n.End && n.Start < m.End {
+				return
+			}
+		}
+		matches = append(matches, m)
+	}
+	for _, rx := range []*regexp.Regexp{markdownInline, markdownAuto, markdownRef} {
+		for _, loc := range rx.FindAllStringSubmatchIndex(text, -1) {
+			start, end := loc[2], loc[3]
+			if strings.HasPrefix(text[start:end], "<") && strings.HasSuffix(text[start:end], ">") {
+				start, end = start+1, end-1
+			}
+			m, ok := e.resolve(text[start:end], base)
+			if !ok {
+				continue
+			}
+			m.Start, m.End, m.Line = start, end, 1+strings.Count(text[:start], "\n")
+			add(m)
+		}
+	}
+	for _, m := range e.Extract(text) {
+		add(m)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Start < matches[j].Start
+	})
+
+	return matches
+}
+
+// ExtractFeed returns the links of RSS and Atom feeds, including links,
+// permalinks, enclosures and media of items, and the links in their HTML
+// content. Relative links are resolved against base and `xml:base`.
+//
+// Offsets of links in HTML content point to the enclosing element.
+func (e *Extractor) ExtractFeed(r io.Reader, base *url.URL) ([]URLMatch, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.CharsetReader = charset.NewReaderLabel
+
+	type element struct {
+		name      string
+		base      *url.URL
+		html      bool // content is escaped HTML
+		permalink bool // text content is a link
+	}
+
+	matches := []URLMatch{}
+	stack := []element{{base: base}}
+	add := func(m URLMatch, ok bool, start, end int) {
+		if !ok {
+			return
+		}
+		m.Start, m.End, m.Line = start, end, 1+bytes.Count(data[:start], []byte("\n"))
+		matches = append(matches, m)
+	}
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.Token()
+		if err == io.EOF {
+			return matches, nil
+		}
+		if err != nil {
+			return matches, err
+		}
+		end := int(d.InputOffset())
+		top := stack[len(stack)-1]
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			el := element{name: t.Name.Local, base: top.base}
+			for _, a := range t.Attr {
+				if a.Name.Space == "http://www.w3.org/XML/1998/namespace" && a.Name.Local == "base" {
+					if u, err := url.Parse(a.Value); err == nil {
+						if el.base != nil {
+							u = el.base.ResolveReference(u)
+						}
+						el.base = u
+					}
+				}
+			}
+			attr := func(name string) (string, bool) {
+				for _, a := range t.Attr {
+					if a.Name.Local == name {
+						return a.Value, true
+					}
+				}
+				return "", false
+			}
+			switch el.name {
+			case "link":
+				if href, ok := attr("href"); ok {
+					m, ok := e.resolve(href, el.base)
+					add(m, ok, start, end)
+				} else {
+					el.permalink = true
+				}
+			case "guid":
+				isPermaLink, _ := attr("isPermaLink")
+				el.permalink = isPermaLink != "false"
+			case "comments", "docs":
+				el.permalink = true
+			case "enclosure", "content", "thumbnail", "player":
+				if link, ok := attr("url"); ok {
+					m, ok := e.resolve(link, el.base)
+					add(m, ok, start, end)
+				}
+				typ, _ := attr("type")
+				el.html = el.name == "content" && (typ == "html" || typ == "xhtml")
+			case "description", "encoded", "summary":
+				el.html = true
+			}
+			stack = append(stack, el)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			text := string(t)
+			switch {
+			case top.permalink:
+				trimmed := strings.TrimSpace(text)
+				offset := start + strings.Index(text, trimmed)
+				m, ok := e.resolve(trimmed, top.base)
+				add(m, ok, offset, offset+len(trimmed))
+			case top.html:
+				found, _ := e.ExtractHTML(strings.NewReader(text), top.base)
+				for _, m := range found {
+					add(m, true, start, end)
+				}
+			}
+		}
+	}
+}
+
+// TelegramEntity is a message entity of the Telegram Bot API, offset
+// and length are in UTF-16 code units.
+type TelegramEntity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url,omitempty"`
+}
+
+// ExtractTelegram returns the links of the url, text_link and email
+// entities of a Telegram message.
+func (e *Extractor) ExtractTelegram(text string, entities []TelegramEntity) []URLMatch {
+	// Map offsets in UTF-16 code units to byte offsets.
+	offsets := make([]int, 0, len(text)+1)
+	for i, r := range text {
+		offsets = append(offsets, i)
+		if r1, _ := utf16.EncodeRune(r); r1 != '\uFFFD' {
+			offsets = append(offsets, i)
+		}
+	}
+	offsets = append(offsets, len(text))
+
+	matches := []URLMatch{}
+	for _, ent := range entities {
+		if ent.Offset < 0 || ent.Length <= 0 || ent.Offset+ent.Length >= len(offsets) {
+			continue
+		}
+		start, end := offsets[ent.Offset], offsets[ent.Offset+ent.Length]
+		var (
+			m  URLMatch
+			ok bool
+		)
+		switch ent.Type {
+		case "url":
+			m, ok = e.match(text[start:end])
+		case "email":
+			m, ok = e.complete(text[start:end], "mailto:"+text[start:end], KindEmail)
+		case "text_link":
+			m, ok = e.resolve(ent.URL, nil)
+			m.Original = text[start:end]
+		}
+		if !ok {
+			continue
+		}
+		m.Start, m.End, m.Line = start, end, 1+strings.Count(text[:start], "\n")
+		matches = append(matches, m)
+	}
+
+	return matches
+}
+
+var slackLink = regexp.MustCompile(`<([^<>|\s@#!][^<>|\s]*)(?:\|[^<>]*)?>`)
+
+var slackUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+
+// ExtractSlack returns the links of Slack message markup, such as
+// `<https://example.com|label>`.
+func (e *Extractor) ExtractSlack(text string) []URLMatch {
+	matches := []URLMatch{}
+	for _, loc := range slackLink.FindAllStringSubmatchIndex(text, -1) {
+		start, end := loc[2], loc[3]
+		m, ok := e.resolve(slackUnescaper.Replace(text[start:end]), nil)
+		if !ok {
+			continue
+		}
+		m.Original = text[start:end]
+		m.Start, m.End, m.Line = start, end, 1+strings.Count(text[:start], "\n")
+		matches = append(matches, m)
+	}
+
+	return matches
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
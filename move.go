@@ -0,0 +1,176 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Mover moves files and directories, the zero value refuses to replace
+// an existing destination.
+type Mover struct {
+	// Overwrite replaces the existing destination.
+	Overwrite bool
+
+	// Xattrs copies extended attributes when moving across devices,
+	// only supported on Linux and macOS.
+	Xattrs bool
+}
+
+// Move renames src to dst, it falls back to copying and removing src if
+// they are on different devices, preserving permissions, times and if
+// possible ownership. The partial destination is removed on failure.
+func (m *Mover) Move(src, dst string) error {
+	if src == dst {
+		return nil
+	}
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+	dstInfo, err := os.Lstat(dst)
+	switch {
+	case err == nil && !m.Overwrite:
+		return &os.PathError{Op: "move", Path: dst, Err: os.ErrExist}
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	exists := err == nil
+
+	if !exists || !dstInfo.IsDir() {
+		err = os.Rename(src, dst)
+		if err == nil || !crossDevice(err) {
+			return err
+		}
+	}
+
+	// Move to a temporary name next to dst first, so dst is replaced
+	// only if the move succeeds.
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+"."+RandString(8, "lower")+".tmp")
+	copied := false
+	if err := os.Rename(src, tmp); err != nil {
+		if !crossDevice(err) {
+			return err
+		}
+		if err := m.copyAll(src, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("move %s to %s: %w", src, dst, err)
+		}
+		copied = true
+	}
+
+	err = nil
+	if exists && dstInfo.IsDir() {
+		err = os.RemoveAll(dst)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		if copied {
+			os.RemoveAll(tmp)
+		} else {
+			os.Rename(tmp, src)
+		}
+		return err
+	}
+	if copied {
+		if err := os.RemoveAll(src); err != nil {
+			return err
+		}
+	}
+
+	return syncDir(filepath.Dir(dst))
+}
+
+// copyAll copies the file or directory src to dst, which must not exist.
+func (m *Mover) copyAll(src, dst string) error {
+	// Directories are read after walked, so their info is kept before
+	// their access times change.
+	var dirs []string
+	var infos []os.FileInfo
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs, infos = append(dirs, rel), append(infos, info)
+			return nil
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			if err := copyRegular(path, target); err != nil {
+				return err
+			}
+			return m.preserve(path, target, info)
+		}
+		return fmt.Errorf("unsupported file type: %s", path)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Preserve directories after their contents, which change their times.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := m.preserve(filepath.Join(src, dirs[i]), filepath.Join(dst, dirs[i]), infos[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyRegular(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// preserve copies the metadata of src to dst, info must be read before
+// copying, which changes the access time of src.
+func (m *Mover) preserve(src, dst string, info os.FileInfo) error {
+	if m.Xattrs {
+		if err := copyXattrs(src, dst); err != nil {
+			return err
+		}
+	}
+	chown(dst, info)
+	if err := os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, atime(info), info.ModTime())
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !plan9
+// +build !linux,!darwin,!plan9
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+func crossDevice(err error) bool {
+	// ERROR_NOT_SAME_DEVICE of Windows.
+	if runtime.GOOS == "windows" && errors.Is(err, syscall.Errno(17)) {
+		return true
+	}
+	return errors.Is(err, syscall.EXDEV)
+}
+
+func atime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+func chown(string, os.FileInfo) {}
+
+func copyXattrs(string, string) error {
+	return nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// crossDevice reports whether the rename could be done by copying, as
+// Plan 9 renames files only within a directory.
+func crossDevice(err error) bool {
+	var linkErr *os.LinkError
+	return errors.As(err, &linkErr) && errors.Is(linkErr.Err, os.ErrInvalid)
+}
+
+func atime(info os.FileInfo) time.Time {
+	if d, ok := info.Sys().(*syscall.Dir); ok {
+		return time.Unix(int64(d.Atime), 0)
+	}
+	return info.ModTime()
+}
+
+func chown(string, os.FileInfo) {}
+
+func copyXattrs(string, string) error {
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// chown preserves the ownership if permitted.
+func chown(path string, info os.FileInfo) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(path, int(st.Uid), int(st.Gid))
+	}
+}
+
+func copyXattrs(src, dst string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		vsize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(src, name, value); err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, name, value[:vsize], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,9 +5,7 @@
 package helper // import "github.com/wabarc/helper"
 
 import (
-	"errors"
-	"net"
-	"os"
+	"context"
 	"time"
 )
 
@@ -16,26 +14,9 @@ import (
 // specific with `TOR_HOST` and `TOR_SOCKS_PORT` environments.
 //
 // ViaTor returns address used by Tor, and an error if
-// Tor proxy missing.
+// Tor proxy missing or it does not speak SOCKS5. Use Tor
+// to connect through the proxy.
 func ViaTor() (addr string, err error) {
-	host := os.Getenv("TOR_HOST")
-	port := os.Getenv("TOR_SOCKS_PORT")
-	if host == "" {
-		host = "127.0.0.1"
-	}
-	if port == "" {
-		port = "9050"
-	}
-
-	addr = net.JoinHostPort(host, port)
-	conn, err := net.DialTimeout("tcp", addr, time.Second)
-	if err != nil {
-		return addr, err
-	}
-	if conn != nil {
-		conn.Close()
-		return addr, nil
-	}
-
-	return addr, errors.New("can not access tor proxy")
+	tor := &Tor{Timeout: time.Second}
+	return tor.Addr(), tor.Check(context.Background())
 }
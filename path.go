@@ -6,7 +6,6 @@ package helper // import "github.com/wabarc/helper"
 
 import (
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 )
@@ -15,15 +14,19 @@ import (
 // system. It finds in different locations on different OS systems.
 // It could perform a rather aggressive search. That may make it a bit slow,
 // but it will only be run when creating a new ExecAllocator.
+// It returns "google-chrome" if not found, use FindBrowser for an error.
 // Fork from: https://github.com/chromedp/chromedp/blob/4ea2300cf7c7065242867bdcb8772533e0a66ea7/allocate.go#L352-L383
 func FindChromeExecPath() string {
-	if path := os.Getenv("CHROME_BIN"); path != "" {
-		found, err := exec.LookPath(path)
-		if err == nil {
-			return found
-		}
+	if path, err := LookupTool("chrome").Path(); err == nil {
+		return path
 	}
+	// Fall back to something simple and sensible, to give a useful error
+	// message.
+	return "google-chrome"
+}
 
+// chromePaths returns the names and locations of Chrome on the OS.
+func chromePaths() []string {
 	var locations []string
 	switch runtime.GOOS {
 	case "darwin":
@@ -62,13 +65,5 @@ func FindChromeExecPath() string {
 		}
 	}
 
-	for _, path := range locations {
-		found, err := exec.LookPath(path)
-		if err == nil {
-			return found
-		}
-	}
-	// Fall back to something simple and sensible, to give a useful error
-	// message.
-	return "google-chrome"
+	return locations
 }
@@ -0,0 +1,292 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Reasons of a redirect chain stopped.
+const (
+	StopFinal   = "final"
+	StopLoop    = "loop"
+	StopMaxHops = "max-hops"
+	StopError   = "error"
+)
+
+// Ways of a hop pointing to the next one.
+const (
+	HopRedirect     = "redirect"
+	HopMetaRefresh  = "meta-refresh"
+	HopInterstitial = "interstitial"
+)
+
+// DefaultMaxHops is the maximum hops of TraceRedirect.
+const DefaultMaxHops = 10
+
+// maxTraceBody is the maximum size of body read for meta refresh.
+const maxTraceBody = 512 << 10
+
+// Hop represents a request of the redirect chain.
+type Hop struct {
+	URL      string
+	Method   string
+	Status   int
+	Location string        // URL of the next hop, empty for the last hop
+	Kind     string        // How Location was found, one of HopRedirect, HopMetaRefresh and HopInterstitial
+	Duration time.Duration // Time taken by the request
+}
+
+// RedirectChain holds every hop from the given link to the destination.
+type RedirectChain struct {
+	Hops   []Hop
+	Reason string // Why the chain stopped
+}
+
+// Final returns the URL of the last hop.
+func (rc *RedirectChain) Final() string {
+	if rc == nil || len(rc.Hops) == 0 {
+		return ""
+	}
+	return rc.Hops[len(rc.Hops)-1].URL
+}
+
+// TraceRedirect traces the redirect chain of the link using DefaultClient.
+func TraceRedirect(link string) (*RedirectChain, error) {
+	return DefaultClient.TraceRedirect(context.Background(), link, DefaultMaxHops)
+}
+
+// TraceRedirect follows HTTP redirects, meta refresh and common shortener
+// interstitials of the link up to maxHops. HEAD requests are sent first,
+// and GET is used if HEAD is rejected or the body is needed.
+//
+// It returns the chain traced so far and an error if a request failed.
+func (c *Client) TraceRedirect(ctx context.Context, link string, maxHops int) (*RedirectChain, error) {
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := *c.httpClient()
+	hc.CheckRedirect = noRedirect
+
+	chain := &RedirectChain{}
+	visited := make(map[string]bool)
+	for {
+		if len(chain.Hops) >= maxHops {
+			chain.Reason = StopMaxHops
+			return chain, nil
+		}
+		visited[u.String()] = true
+
+		hop, next, err := c.hop(ctx, &hc, u)
+		chain.Hops = append(chain.Hops, hop)
+		if err != nil {
+			chain.Reason = StopError
+			return chain, err
+		}
+		if next == nil {
+			chain.Reason = StopFinal
+			return chain, nil
+		}
+		if visited[next.String()] {
+			chain.Reason = StopLoop
+			return chain, nil
+		}
+		u = next
+	}
+}
+
+func (c *Client) hop(ctx context.Context, hc *http.Client, u *url.URL) (hop Hop, next *url.URL, err error) {
+	hop = Hop{URL: u.String()}
+	if target := interstitialTarget(u); target != nil {
+		hop.Location, hop.Kind = target.String(), HopInterstitial
+		return hop, target, nil
+	}
+
+	start := time.Now()
+	defer func() { hop.Duration = time.Since(start) }()
+
+	hop.Method = http.MethodHead
+	resp, err := c.do(ctx, hc, request(http.MethodHead, u.String()))
+	if err != nil || headRejected(resp.StatusCode) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		hop.Method = http.MethodGet
+		resp, err = c.do(ctx, hc, request(http.MethodGet, u.String()))
+	}
+	if err != nil {
+		return hop, nil, err
+	}
+	defer resp.Body.Close()
+	hop.Status = resp.StatusCode
+
+	if isRedirect(resp.StatusCode) {
+		loc, err := resp.Location()
+		if err != nil {
+			if errors.Is(err, http.ErrNoLocation) {
+				return hop, nil, nil
+			}
+			return hop, nil, err
+		}
+		hop.Location, hop.Kind = loc.String(), HopRedirect
+		return hop, loc, nil
+	}
+
+	if resp.StatusCode != http.StatusOK || !isHTML(resp.Header.Get("Content-Type")) {
+		return hop, nil, nil
+	}
+	if hop.Method == http.MethodHead {
+		resp.Body.Close()
+		hop.Method = http.MethodGet
+		resp, err = c.do(ctx, hc, request(http.MethodGet, u.String()))
+		if err != nil {
+			return hop, nil, err
+		}
+		defer resp.Body.Close()
+		hop.Status = resp.StatusCode
+	}
+
+	loc, kind := scanRefresh(io.LimitReader(resp.Body, maxTraceBody), u)
+	if loc != nil {
+		hop.Location, hop.Kind = loc.String(), kind
+	}
+	return hop, loc, nil
+}
+
+func headRejected(code int) bool {
+	switch code {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func isHTML(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "text/html" || mt == "application/xhtml+xml"
+}
+
+// interstitials maps the host and path of well-known link wrappers
+// to the query parameter which carries the destination.
+var interstitials = map[string]string{
+	"l.facebook.com/l.php":           "u",
+	"lm.facebook.com/l.php":          "u",
+	"l.instagram.com/":               "u",
+	"www.google.com/url":             "q",
+	"google.com/url":                 "q",
+	"www.youtube.com/redirect":       "q",
+	"youtube.com/redirect":           "q",
+	"steamcommunity.com/linkfilter/": "url",
+	"out.reddit.com/":                "url",
+	"www.linkedin.com/safety/go":     "url",
+	"vk.com/away.php":                "to",
+	"slack-redir.net/link":           "url",
+}
+
+// interstitialTarget returns the destination of the link wrapped by a
+// well-known interstitial, without sending a request.
+func interstitialTarget(u *url.URL) *url.URL {
+	key, ok := interstitials[strings.ToLower(u.Host)+u.Path]
+	if !ok {
+		return nil
+	}
+	target, err := url.Parse(u.Query().Get(key))
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil
+	}
+	return target
+}
+
+// scanRefresh finds the target of meta refresh, or the link of the
+// "continue" anchor on shortener interstitial pages.
+func scanRefresh(r io.Reader, base *url.URL) (*url.URL, string) {
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return nil, ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "meta":
+				if !strings.EqualFold(attr(tok, "http-equiv"), "refresh") {
+					continue
+				}
+				if loc := refreshURL(attr(tok, "content"), base); loc != nil {
+					return loc, HopMetaRefresh
+				}
+			case "a":
+				// LinkedIn and similar shorteners render a JavaScript-free
+				// interstitial with a marked anchor to the destination.
+				if attr(tok, "data-tracking-control-name") != "external_url_click" {
+					continue
+				}
+				if loc, err := base.Parse(attr(tok, "href")); err == nil {
+					return loc, HopInterstitial
+				}
+			}
+		}
+	}
+}
+
+// refreshURL parses the content of meta refresh, e.g. `0; url=/next`.
+func refreshURL(content string, base *url.URL) *url.URL {
+	parts := strings.SplitN(content, ";", 2)
+	if len(parts) < 2 {
+		return nil
+	}
+	// The URL may follow "url" and "=" with spaces around.
+	target := strings.TrimSpace(parts[1])
+	if len(target) >= 3 && strings.EqualFold(target[:3], "url") {
+		if rest := strings.TrimSpace(target[3:]); strings.HasPrefix(rest, "=") {
+			target = rest[1:]
+		}
+	}
+	target = strings.Trim(strings.TrimSpace(target), `'"`)
+	if target == "" {
+		return nil
+	}
+	loc, err := base.Parse(target)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
+
+func attr(tok html.Token, key string) string {
+	for _, a := range tok.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Shortener shortens links.
+type Shortener interface {
+	Shorten(ctx context.Context, link string) (string, error)
+}
+
+var (
+	_ Shortener = (*TinyURLShortener)(nil)
+	_ Shortener = (*LocalShortener)(nil)
+)
+
+// TinyURLShortener shortens links using the tinyurl.com service.
+type TinyURLShortener struct {
+	// Client sends requests, DefaultClient is used if nil.
+	Client *Client
+}
+
+// Shorten implements the Shortener interface.
+func (s *TinyURLShortener) Shorten(ctx context.Context, link string) (string, error) {
+	c := s.Client
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.TinyURL(ctx, link)
+}
+
+// LocalShortener is a self-hosted shortener, it keeps the codes in memory
+// and persists them to a JSON file if specified. It is also an http.Handler
+// which redirects the short links to the original links.
+type LocalShortener struct {
+	baseURL string
+	file    string
+	length  int
+
+	mu    sync.RWMutex
+	links map[string]string // code to link
+	codes map[string]string // link to code
+}
+
+// NewLocalShortener returns a LocalShortener that generates short links
+// prefixed with baseURL, e.g. `https://s.example.org/`. Codes are loaded
+// from and saved to file unless it is empty.
+func NewLocalShortener(baseURL, file string) (*LocalShortener, error) {
+	s := &LocalShortener{
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/",
+		file:    file,
+		length:  6,
+		links:   make(map[string]string),
+		codes:   make(map[string]string),
+	}
+	if file == "" || !Exists(file) {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, &s.links); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", file, err)
+	}
+	for code, link := range s.links {
+		s.codes[link] = code
+	}
+
+	return s, nil
+}
+
+// Shorten implements the Shortener interface, a link is always
+// shortened to the same code.
+func (s *LocalShortener) Shorten(_ context.Context, link string) (string, error) {
+	if !IsURL(link) {
+		return "", fmt.Errorf("invalid url: %s", link)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if code, ok := s.codes[link]; ok {
+		return s.baseURL + code, nil
+	}
+
+	code := RandString(s.length, "")
+	for _, ok := s.links[code]; ok; _, ok = s.links[code] {
+		code = RandString(s.length, "")
+	}
+	s.links[code] = link
+	s.codes[link] = code
+
+	if err := s.save(); err != nil {
+		delete(s.links, code)
+		delete(s.codes, link)
+		return "", err
+	}
+
+	return s.baseURL + code, nil
+}
+
+// Expand returns the original link of the code or the short link.
+func (s *LocalShortener) Expand(code string) (string, bool) {
+	code = path.Base(strings.TrimPrefix(code, s.baseURL))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	link, ok := s.links[code]
+	return link, ok
+}
+
+// ServeHTTP redirects the request to the original link of the code
+// in the last path segment.
+func (s *LocalShortener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	link, ok := s.Expand(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, link, http.StatusMovedPermanently)
+}
+
+func (s *LocalShortener) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.links)
+	if err != nil {
+		return err
+	}
+	return (&AtomicWriter{Perm: 0600}).WriteFile(s.file, data)
+}
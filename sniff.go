@@ -0,0 +1,161 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// SniffLen is the number of bytes used by SniffContentType.
+const SniffLen = 512
+
+// preferredExtensions are the extensions of media types, which take
+// precedence over the system mime table.
+var preferredExtensions = map[string]string{
+	"application/epub+zip":     ".epub",
+	"application/gzip":         ".gz",
+	"application/javascript":   ".js",
+	"application/json":         ".json",
+	"application/ogg":          ".ogg",
+	"application/pdf":          ".pdf",
+	"application/rss+xml":      ".rss",
+	"application/atom+xml":     ".atom",
+	"application/wasm":         ".wasm",
+	"application/warc":         ".warc",
+	"application/x-gzip":       ".gz",
+	"application/xhtml+xml":    ".xhtml",
+	"application/xml":          ".xml",
+	"application/zip":          ".zip",
+	"audio/mpeg":               ".mp3",
+	"audio/ogg":                ".ogg",
+	"audio/wave":               ".wav",
+	"font/woff":                ".woff",
+	"font/woff2":               ".woff2",
+	"image/avif":               ".avif",
+	"image/bmp":                ".bmp",
+	"image/gif":                ".gif",
+	"image/heic":               ".heic",
+	"image/jpeg":               ".jpg",
+	"image/png":                ".png",
+	"image/svg+xml":            ".svg",
+	"image/vnd.microsoft.icon": ".ico",
+	"image/webp":               ".webp",
+	"image/x-icon":             ".ico",
+	"text/css":                 ".css",
+	"text/csv":                 ".csv",
+	"text/html":                ".html",
+	"text/javascript":          ".js",
+	"text/markdown":            ".md",
+	"text/plain":               ".txt",
+	"text/xml":                 ".xml",
+	"video/mp4":                ".mp4",
+	"video/webm":               ".webm",
+}
+
+// genericTypes are the media types that tell nothing about the content.
+var genericTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"application/unknown":      true,
+	"binary/octet-stream":      true,
+	"text/plain":               true,
+}
+
+// ftypBrands are the major brands of ISO base media files.
+var ftypBrands = map[string]string{
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heic",
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"dash": "video/mp4",
+	"M4V ": "video/mp4",
+}
+
+// SniffContentType returns the media type of the content by its first
+// bytes. Magic numbers of formats such as PDF, WARC and WebP take
+// precedence over contentType, then the type detected by
+// http.DetectContentType unless it is text, then contentType.
+func SniffContentType(head []byte, contentType string) string {
+	if typ := magic(head); typ != "" {
+		return typ
+	}
+
+	declared := mediaType(contentType)
+	detected := http.DetectContentType(head)
+	switch {
+	case len(head) == 0:
+		return contentType
+	case genericTypes[declared]:
+		if mediaType(detected) == "text/plain" && declared != "" {
+			return contentType
+		}
+		return detected
+	case mediaType(detected) == "application/octet-stream",
+		strings.HasPrefix(detected, "text/"):
+		return contentType
+	}
+	return detected
+}
+
+// magic returns the media type of the signatures not recognized by
+// http.DetectContentType, or empty if unknown.
+func magic(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return "application/pdf"
+	case bytes.HasPrefix(head, []byte("WARC/")):
+		return "application/warc"
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && string(head[8:12]) == "WEBP":
+		return "image/webp"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return ftypBrands[string(head[8:12])]
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		if len(head) >= 58 && string(head[30:58]) == "mimetypeapplication/epub+zip" {
+			return "application/epub+zip"
+		}
+		return "application/zip"
+	case bytes.HasPrefix(head, []byte("\x1f\x8b\x08")):
+		return "application/gzip"
+	}
+	return ""
+}
+
+// mediaType returns the media type without parameters in lower case.
+func mediaType(contentType string) string {
+	if typ, _, err := mime.ParseMediaType(contentType); err == nil {
+		return typ
+	}
+	typ := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return strings.ToLower(typ)
+}
+
+// extension returns the extension of the content type, defaults to .html.
+func extension(contentType string) string {
+	if ext, ok := preferredExtensions[mediaType(contentType)]; ok {
+		return ext
+	}
+	ext := ".html"
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		ext = exts[0]
+		if strings.HasSuffix(ext, "htm") {
+			ext = strings.ReplaceAll(ext, "htm", "html")
+		}
+	}
+	for _, e := range []string{"jpe", "jpeg"} {
+		if strings.HasSuffix(ext, e) {
+			ext = strings.ReplaceAll(ext, e, "jpg")
+		}
+	}
+	return ext
+}
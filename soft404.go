@@ -0,0 +1,154 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// notFoundPhrases are the common phrases of soft 404 pages, in lower case.
+var notFoundPhrases = []string{
+	"page not found",
+	"404 not found",
+	"not be found",
+	"doesn't exist",
+	"does not exist",
+	"no longer available",
+	"no longer exists",
+	"has been removed",
+	"has been deleted",
+	"nothing was found",
+	"页面不存在",
+	"找不到",
+	"已被删除",
+	"ページが見つかりません",
+}
+
+var titleRegexp = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// Soft404 returns the confidence, from 0 to 1, that the link is a soft 404,
+// a page responds 200 but tells the visitor it is not found. The response is
+// matched against the common phrases of not found pages, and compared with
+// a probe for a random sibling path. Each of them contributes half of the
+// score, so neither a phrase nor a similar probe alone, e.g. single-page
+// apps serving the same page for every path, exceeds 0.5. Hard 404 and
+// 410 responses return 1.
+func (c *Client) Soft404(ctx context.Context, link string) (float64, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, body, err := c.fetch(ctx, u.String())
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return 1, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return 0, nil
+	}
+
+	return c.soft404(ctx, u, resp.Request.URL, body), nil
+}
+
+// soft404 scores the response of u which ends with final and body.
+func (c *Client) soft404(ctx context.Context, u, final *url.URL, body []byte) float64 {
+	phrase := phraseScore(body)
+
+	token := RandString(16, "lower")
+	probe := *u
+	probe.RawPath = ""
+	probe.RawQuery = ""
+	probe.Path = path.Join(path.Dir("/"+strings.TrimPrefix(u.Path, "/")), token) + path.Ext(u.Path)
+	resp, probeBody, err := c.fetch(ctx, probe.String())
+	if err != nil {
+		return phrase / 2
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// The site reports missing pages properly.
+		return phrase * 0.4
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return phrase / 2
+	case final.String() != u.String() && resp.Request.URL.String() == final.String():
+		// Both the link and a missing page redirect to the same page.
+		return (phrase + 1) / 2
+	}
+
+	// Pages often echo the requested path, which should not be compared.
+	if name := strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path)); len(name) > 1 {
+		body = bytes.ReplaceAll(body, []byte(name), nil)
+	}
+	probeBody = bytes.ReplaceAll(probeBody, []byte(token), nil)
+	return (phrase + similarity(body, probeBody)) / 2
+}
+
+func (c *Client) fetch(ctx context.Context, link string) (*http.Response, []byte, error) {
+	resp, err := c.do(ctx, c.httpClient(), request(http.MethodGet, link))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	return resp, body, err
+}
+
+// phraseScore matches the title and body with phrases of not found pages.
+func phraseScore(body []byte) float64 {
+	body = bytes.ToLower(body)
+	if m := titleRegexp.FindSubmatch(body); m != nil {
+		title := m[1]
+		if bytes.Contains(title, []byte("404")) {
+			return 1
+		}
+		for _, phrase := range notFoundPhrases {
+			if bytes.Contains(title, []byte(phrase)) {
+				return 1
+			}
+		}
+	}
+	for _, phrase := range notFoundPhrases {
+		if bytes.Contains(body, []byte(phrase)) {
+			return 0.6
+		}
+	}
+	return 0
+}
+
+// similarity returns the Jaccard index of words of a and b.
+func similarity(a, b []byte) float64 {
+	wa, wb := words(a), words(b)
+	if len(wa) == 0 && len(wb) == 0 {
+		return 1
+	}
+
+	var inter int
+	for w := range wa {
+		if wb[w] {
+			inter++
+		}
+	}
+	return float64(inter) / float64(len(wa)+len(wb)-inter)
+}
+
+func words(b []byte) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(string(b)) {
+		set[w] = true
+	}
+	return set
+}
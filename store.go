@@ -0,0 +1,290 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a content-addressed store, which keeps identical blobs once.
+// Blobs are named by their SHA-256 digest in hex and sharded into
+// `objects/ab/cd/<digest>`, and referenced by aliases under `aliases/`,
+// e.g. names generated by FileName. Blobs without aliases are removed
+// by GC.
+type Store struct {
+	// Symlink creates aliases as symbolic links instead of hard links.
+	Symlink bool
+
+	dir     string
+	mu      sync.Mutex
+	aliases map[string]string // alias -> digest
+}
+
+// NewStore opens the store in the directory, which is created if missing.
+func NewStore(dir string) (*Store, error) {
+	if err := Writable(dir); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, aliases: make(map[string]string)}
+	data, err := os.ReadFile(s.index())
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &s.aliases); err != nil {
+			return nil, fmt.Errorf("load store index: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Put stores the data and returns its digest.
+func (s *Store) Put(data []byte) (string, error) {
+	return s.PutReader(context.Background(), bytes.NewReader(data))
+}
+
+// PutReader stores the content of r and returns its digest.
+func (s *Store) PutReader(ctx context.Context, r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(s.dir, ".put-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	result, err := (&Copier{}).Copy(ctx, tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	digest := result.Hex()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.Path(digest)
+	if err != nil {
+		return "", err
+	}
+	if Exists(path) {
+		// Refresh the time to protect it from GC.
+		now := time.Now()
+		return digest, os.Chtimes(path, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+
+	return digest, syncDir(filepath.Dir(path))
+}
+
+// Path returns the path of the blob, the digest must be SHA-256 in hex.
+func (s *Store) Path(digest string) (string, error) {
+	if !validDigest(digest) {
+		return "", fmt.Errorf("invalid digest: %s", digest)
+	}
+	return filepath.Join(s.dir, "objects", digest[:2], digest[2:4], digest), nil
+}
+
+// Has reports whether the blob exists.
+func (s *Store) Has(digest string) bool {
+	path, err := s.Path(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Open opens the blob for reading.
+func (s *Store) Open(digest string) (*os.File, error) {
+	path, err := s.Path(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Link creates the alias of the blob and returns its path, the alias is
+// a relative path, e.g. a name generated by FileName. An existing alias
+// is replaced.
+func (s *Store) Link(digest, alias string) (string, error) {
+	path, err := s.aliasPath(alias)
+	if err != nil {
+		return "", err
+	}
+	alias = filepath.ToSlash(filepath.Clean(alias))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blob, err := s.Path(digest)
+	if err != nil {
+		return "", err
+	}
+	if !Exists(blob) {
+		return "", fmt.Errorf("blob %s: %w", digest, os.ErrNotExist)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if s.Symlink {
+		err = s.symlink(blob, path)
+	} else if err = os.Link(blob, path); err != nil {
+		err = s.symlink(blob, path)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s.aliases[alias] = digest
+	return path, s.save()
+}
+
+func (s *Store) symlink(blob, path string) error {
+	target, err := filepath.Rel(filepath.Dir(path), blob)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+// Unlink removes the alias.
+func (s *Store) Unlink(alias string) error {
+	path, err := s.aliasPath(alias)
+	if err != nil {
+		return err
+	}
+	alias = filepath.ToSlash(filepath.Clean(alias))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.aliases[alias]; !ok {
+		return fmt.Errorf("alias %s: %w", alias, os.ErrNotExist)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.aliases, alias)
+	return s.save()
+}
+
+// Resolve returns the digest of the alias.
+func (s *Store) Resolve(alias string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	digest, ok := s.aliases[filepath.ToSlash(filepath.Clean(alias))]
+	return digest, ok
+}
+
+// Refs returns the number of aliases of the blob.
+func (s *Store) Refs(digest string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, d := range s.aliases {
+		if d == digest {
+			n++
+		}
+	}
+	return n
+}
+
+// GC removes the blobs without aliases that are not modified within
+// minAge, so blobs being put are kept until linked. It returns the
+// digests of removed blobs.
+func (s *Store) GC(minAge time.Duration) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs := make(map[string]bool, len(s.aliases))
+	for _, digest := range s.aliases {
+		refs[digest] = true
+	}
+
+	removed := []string{}
+	deadline := time.Now().Add(-minAge)
+	err := filepath.Walk(filepath.Join(s.dir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		digest := info.Name()
+		if refs[digest] || info.ModTime().After(deadline) {
+			return nil
+		}
+		// Blobs are read-only, which could not be removed on Windows.
+		os.Chmod(path, 0644)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed = append(removed, digest)
+		return nil
+	})
+
+	return removed, err
+}
+
+func (s *Store) aliasPath(alias string) (string, error) {
+	clean := filepath.Clean(alias)
+	if alias == "" || filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid alias: %s", alias)
+	}
+	return filepath.Join(s.dir, "aliases", clean), nil
+}
+
+// validDigest reports whether the digest is SHA-256 in hex.
+func validDigest(digest string) bool {
+	if len(digest) != 64 {
+		return false
+	}
+	for i := 0; i < len(digest); i++ {
+		if !isHex(digest[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) index() string {
+	return filepath.Join(s.dir, "aliases.json")
+}
+
+func (s *Store) save() error {
+	data, err := json.Marshal(s.aliases)
+	if err != nil {
+		return err
+	}
+	return (&AtomicWriter{}).WriteFile(s.index(), data)
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Digest algorithms of Copier.
+const (
+	DigestSHA256 = "sha256"
+	DigestSHA1   = "sha1"
+)
+
+// ErrTooLarge is returned when the content exceeds the maximum size.
+var ErrTooLarge = errors.New("content too large")
+
+// Copier copies streams, the zero value copies without limit and
+// computes the SHA-256 digest.
+type Copier struct {
+	// MaxSize is the maximum size in bytes, 0 means no limit.
+	MaxSize int64
+
+	// Progress is called with the number of bytes written so far.
+	Progress func(written int64)
+
+	// Digest is the digest algorithm, DigestSHA256 or DigestSHA1,
+	// defaults to DigestSHA256.
+	Digest string
+
+	// BufferSize is the size of the copy buffer, defaults to 32 KiB.
+	BufferSize int
+}
+
+// CopyResult is the result of a copy.
+type CopyResult struct {
+	Size      int64  // Number of bytes written
+	Algorithm string // Digest algorithm
+	Digest    []byte // Digest of the content
+}
+
+// Hex returns the digest in hex.
+func (r *CopyResult) Hex() string {
+	return hex.EncodeToString(r.Digest)
+}
+
+// WARCDigest returns the digest in the format of WARC-Payload-Digest,
+// e.g. "sha1:2Z6TGB2OXGUJZKPGQYE4ZGMZWOIRNMVX".
+func (r *CopyResult) WARCDigest() string {
+	return r.Algorithm + ":" + base32.StdEncoding.EncodeToString(r.Digest)
+}
+
+// WriteReader writes the content of r to the file atomically.
+func WriteReader(ctx context.Context, path string, r io.Reader, mode os.FileMode) (*CopyResult, error) {
+	return (&Copier{}).WriteFile(ctx, path, r, mode)
+}
+
+// Copy copies from src to dst until EOF, the maximum size is exceeded or
+// ctx is done. Cancellation is checked between reads, so a blocked read
+// is not interrupted.
+func (c *Copier) Copy(ctx context.Context, dst io.Writer, src io.Reader) (*CopyResult, error) {
+	h, err := c.hash()
+	if err != nil {
+		return nil, err
+	}
+	size := c.BufferSize
+	if size <= 0 {
+		size = 32 << 10
+	}
+
+	result := &CopyResult{Algorithm: c.digest()}
+	buf := make([]byte, size)
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if c.MaxSize > 0 && result.Size+int64(n) > c.MaxSize {
+				return result, fmt.Errorf("%w: exceeds %d bytes", ErrTooLarge, c.MaxSize)
+			}
+			h.Write(buf[:n])
+			w, werr := dst.Write(buf[:n])
+			result.Size += int64(w)
+			if werr == nil && w < n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return result, werr
+			}
+			if c.Progress != nil {
+				c.Progress(result.Size)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return result, rerr
+		}
+	}
+	result.Digest = h.Sum(nil)
+
+	return result, nil
+}
+
+// WriteFile writes the content of r to the file atomically, the file is
+// left untouched if the copy fails.
+func (c *Copier) WriteFile(ctx context.Context, path string, r io.Reader, mode os.FileMode) (*CopyResult, error) {
+	f, err := (&AtomicWriter{Perm: mode, PreservePerm: true}).Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result, err := c.Copy(ctx, f, r)
+	if err != nil {
+		return result, err
+	}
+	return result, f.Commit()
+}
+
+// CopyFile copies the file src to dst atomically, dst is created with
+// the permission of src.
+func (c *Copier) CopyFile(ctx context.Context, src, dst string) (*CopyResult, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &os.PathError{Op: "copy", Path: src, Err: errors.New("is a directory")}
+	}
+
+	return c.WriteFile(ctx, dst, in, info.Mode().Perm())
+}
+
+func (c *Copier) digest() string {
+	if c.Digest == "" {
+		return DigestSHA256
+	}
+	return c.Digest
+}
+
+func (c *Copier) hash() (hash.Hash, error) {
+	switch c.digest() {
+	case DigestSHA256:
+		return sha256.New(), nil
+	case DigestSHA1:
+		return sha1.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm: %s", c.Digest)
+}
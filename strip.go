@@ -0,0 +1,275 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"mvdan.cc/xurls/v2"
+)
+
+// Matching modes of a Rule.
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchRegex  = "regex"
+)
+
+// Rule describes a query parameter that should be stripped from URLs.
+type Rule struct {
+	// Host restricts the rule to the host and its subdomains,
+	// an empty value applies the rule to every host.
+	Host string `json:"host,omitempty"`
+
+	// Match is one of MatchExact, MatchPrefix and MatchRegex,
+	// it defaults to MatchExact. Exact matching is case-insensitive,
+	// regular expressions must match the whole parameter name.
+	Match string `json:"match,omitempty"`
+
+	// Param is the name, prefix or regular expression of the parameter.
+	Param string `json:"param"`
+}
+
+// RuleSet is a compiled set of rules used to strip tracking parameters,
+// it is safe for concurrent use. A nil RuleSet uses the default rules.
+type RuleSet struct {
+	rules []rule
+}
+
+type rule struct {
+	Rule
+
+	rx *regexp.Regexp
+}
+
+// defaultRules mirrors the widely used tracking parameters collected by
+// catalogues such as ClearURLs.
+var defaultRules = []Rule{
+	// Generic campaign and click identifiers
+	{Match: MatchPrefix, Param: "utm_"},
+	{Match: MatchPrefix, Param: "at_custom"},
+	{Match: MatchPrefix, Param: "at_medium"},
+	{Match: MatchPrefix, Param: "pk_"},
+	{Match: MatchPrefix, Param: "mtm_"},
+	{Match: MatchPrefix, Param: "hsa_"},
+	{Match: MatchPrefix, Param: "vero_"},
+	{Match: MatchPrefix, Param: "oly_"},
+	{Match: MatchPrefix, Param: "__hs"},
+	{Match: MatchExact, Param: "fbclid"},
+	{Match: MatchExact, Param: "gclid"},
+	{Match: MatchExact, Param: "gclsrc"},
+	{Match: MatchExact, Param: "dclid"},
+	{Match: MatchExact, Param: "wbraid"},
+	{Match: MatchExact, Param: "gbraid"},
+	{Match: MatchExact, Param: "msclkid"},
+	{Match: MatchExact, Param: "yclid"},
+	{Match: MatchExact, Param: "twclid"},
+	{Match: MatchExact, Param: "ttclid"},
+	{Match: MatchExact, Param: "igshid"},
+	{Match: MatchExact, Param: "mc_cid"},
+	{Match: MatchExact, Param: "mc_eid"},
+	{Match: MatchExact, Param: "mkt_tok"},
+	{Match: MatchExact, Param: "_openstat"},
+	{Match: MatchExact, Param: "_hsenc"},
+	{Match: MatchExact, Param: "_hsmi"},
+	{Match: MatchExact, Param: "wickedid"},
+	{Match: MatchExact, Param: "weibo_id"},
+	{Match: MatchExact, Param: "chksm"},
+
+	// Host specific share tokens
+	{Host: "instagram.com", Match: MatchExact, Param: "igsh"},
+	{Host: "twitter.com", Match: MatchExact, Param: "s"},
+	{Host: "twitter.com", Match: MatchExact, Param: "t"},
+	{Host: "twitter.com", Match: MatchExact, Param: "ref_src"},
+	{Host: "twitter.com", Match: MatchExact, Param: "ref_url"},
+	{Host: "x.com", Match: MatchExact, Param: "s"},
+	{Host: "x.com", Match: MatchExact, Param: "t"},
+	{Host: "youtube.com", Match: MatchExact, Param: "si"},
+	{Host: "youtube.com", Match: MatchExact, Param: "feature"},
+	{Host: "youtu.be", Match: MatchExact, Param: "si"},
+	{Host: "spotify.com", Match: MatchExact, Param: "si"},
+	{Host: "reddit.com", Match: MatchExact, Param: "share_id"},
+	{Host: "reddit.com", Match: MatchExact, Param: "rdt"},
+	{Host: "bilibili.com", Match: MatchRegex, Param: "share_[a-z_]+"},
+	{Host: "bilibili.com", Match: MatchExact, Param: "spm_id_from"},
+	{Host: "bilibili.com", Match: MatchExact, Param: "vd_source"},
+	{Host: "bilibili.com", Match: MatchExact, Param: "unique_k"},
+	{Host: "taobao.com", Match: MatchExact, Param: "spm"},
+	{Host: "tmall.com", Match: MatchExact, Param: "spm"},
+	{Host: "aliexpress.com", Match: MatchExact, Param: "spm"},
+	{Host: "aliexpress.com", Match: MatchExact, Param: "scm"},
+	{Host: "amazon.com", Match: MatchRegex, Param: "p[fd]_rd_[a-z]+"},
+	{Host: "amazon.com", Match: MatchExact, Param: "_encoding"},
+	{Host: "zhihu.com", Match: MatchExact, Param: "share_code"},
+	{Host: "weixin.qq.com", Match: MatchExact, Param: "sharer_shareid"},
+	{Host: "weixin.qq.com", Match: MatchExact, Param: "sharer_sharetime"},
+}
+
+var defaultRuleSet = mustRuleSet(defaultRules...)
+
+func mustRuleSet(rules ...Rule) *RuleSet {
+	rs, err := NewRuleSet(rules...)
+	if err != nil {
+		panic(err)
+	}
+	return rs
+}
+
+// DefaultRules returns a copy of the bundled rules, it could be
+// extended and passed to NewRuleSet.
+func DefaultRules() []Rule {
+	rules := make([]Rule, len(defaultRules))
+	copy(rules, defaultRules)
+	return rules
+}
+
+// NewRuleSet compiles given rules to a RuleSet.
+func NewRuleSet(rules ...Rule) (*RuleSet, error) {
+	rs := &RuleSet{rules: make([]rule, 0, len(rules))}
+	for _, r := range rules {
+		if r.Param == "" {
+			return nil, fmt.Errorf("rule missing param")
+		}
+		r.Host = strings.TrimPrefix(strings.ToLower(r.Host), ".")
+		cr := rule{Rule: r}
+		switch r.Match {
+		case "", MatchExact:
+			cr.Match = MatchExact
+		case MatchPrefix:
+		case MatchRegex:
+			rx, err := regexp.Compile(`^(?:` + r.Param + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %s: %v", r.Param, err)
+			}
+			cr.rx = rx
+		default:
+			return nil, fmt.Errorf("unknown match mode: %s", r.Match)
+		}
+		rs.rules = append(rs.rules, cr)
+	}
+	return rs, nil
+}
+
+// LoadRules reads rules from a JSON array, e.g.
+//
+//	[{"host": "example.com", "match": "prefix", "param": "ref_"}]
+func LoadRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadRuleSet reads rules from the JSON file of the given path and compiles
+// them to a RuleSet. The bundled rules are included if withDefault is true.
+func LoadRuleSet(path string, withDefault bool) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := LoadRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse rules failed: %v", err)
+	}
+	if withDefault {
+		rules = append(DefaultRules(), rules...)
+	}
+	return NewRuleSet(rules...)
+}
+
+// Rules returns the rules of the RuleSet.
+func (rs *RuleSet) Rules() []Rule {
+	if rs == nil {
+		return DefaultRules()
+	}
+	rules := make([]Rule, len(rs.rules))
+	for i, r := range rs.rules {
+		rules[i] = r.Rule
+	}
+	return rules
+}
+
+// Strip removes tracking parameters from the link, it returns an empty
+// string if the link is invalid.
+func (rs *RuleSet) Strip(link string) string {
+	if rs == nil {
+		rs = defaultRuleSet
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	queries := u.Query()
+	for key := range queries {
+		for _, r := range rs.rules {
+			if r.matchHost(host) && r.matchParam(key) {
+				queries.Del(key)
+				break
+			}
+		}
+	}
+
+	u.RawQuery = queries.Encode()
+
+	return u.String()
+}
+
+// MatchURL is extract URL from text and strip it using the RuleSet,
+// returns []string always.
+func (rs *RuleSet) MatchURL(text string) []string {
+	urls := []string{}
+	rx := xurls.Strict()
+	matches := rx.FindAllString(text, -1)
+	for _, el := range matches {
+		urls = append(urls, rs.Strip(el))
+	}
+
+	return urls
+}
+
+// MatchURLFallback is same as MatchURL, and replaces dead links with
+// snapshots found by DefaultFallback, returns []string always.
+func (rs *RuleSet) MatchURLFallback(text string) []string {
+	f := *DefaultFallback
+	f.Rules = rs
+
+	urls := []string{}
+	for _, result := range f.MatchURL(context.Background(), text) {
+		urls = append(urls, result.URL)
+	}
+
+	return urls
+}
+
+func (r rule) matchHost(host string) bool {
+	if r.Host == "" {
+		return true
+	}
+	return host == r.Host || strings.HasSuffix(host, "."+r.Host)
+}
+
+func (r rule) matchParam(key string) bool {
+	switch r.Match {
+	case MatchPrefix:
+		return strings.HasPrefix(key, r.Param)
+	case MatchRegex:
+		return r.rx.MatchString(key)
+	default:
+		return strings.EqualFold(key, r.Param)
+	}
+}
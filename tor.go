@@ -0,0 +1,195 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ErrNotSOCKS5 is returned when the proxy does not speak SOCKS5.
+var ErrNotSOCKS5 = errors.New("not a SOCKS5 proxy")
+
+// Tor is the SOCKS5 proxy of Tor. The zero value uses the `TOR_HOST` and
+// `TOR_SOCKS_PORT` environments, which default to 127.0.0.1 and 9050.
+//
+// Hosts are resolved by Tor, so .onion hosts are reachable, and DNS
+// queries do not leak. Streams are isolated by SOCKS credentials, which
+// requires the IsolateSOCKSAuth flag of the SocksPort, enabled by default.
+type Tor struct {
+	// Host is the host of the proxy, overrides `TOR_HOST`.
+	Host string
+
+	// Port is the port of the proxy, overrides `TOR_SOCKS_PORT`.
+	Port string
+
+	// Isolate uses distinct credentials for every connection, so Tor
+	// builds separate circuits for them, and disables keep-alives of
+	// Transport, so every request has its own circuit. Connections
+	// with an isolation key of WithTorIsolation share the circuit.
+	Isolate bool
+
+	// Timeout is the timeout of connecting to the proxy, and of the
+	// negotiation of Check, defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+type torIsolationKey struct{}
+
+// WithTorIsolation returns a context whose connections through Tor use
+// the credentials of the key, connections of the same key share circuits.
+func WithTorIsolation(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, torIsolationKey{}, key)
+}
+
+// IsOnion reports whether the host, which may have a port, is an onion service.
+func IsOnion(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.HasSuffix(host, ".onion")
+}
+
+// Addr returns the address of the proxy.
+func (t *Tor) Addr() string {
+	host, port := t.Host, t.Port
+	if host == "" {
+		host = os.Getenv("TOR_HOST")
+	}
+	if port == "" {
+		port = os.Getenv("TOR_SOCKS_PORT")
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if port == "" {
+		port = "9050"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (t *Tor) dialer() *net.Dialer {
+	timeout := t.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+}
+
+// Check checks the proxy by the SOCKS5 method negotiation, it returns
+// ErrNotSOCKS5 if the listener does not speak SOCKS5.
+func (t *Tor) Check(ctx context.Context) error {
+	d := t.dialer()
+	conn, err := d.DialContext(ctx, "tcp", t.Addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(d.Timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+	// Version 5, offering no authentication and username/password.
+	if _, err := conn.Write([]byte{0x05, 0x02, 0x00, 0x02}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotSOCKS5, err)
+	}
+	if reply[0] != 0x05 || (reply[1] != 0x00 && reply[1] != 0x02) {
+		return fmt.Errorf("%w: unexpected reply %x", ErrNotSOCKS5, reply)
+	}
+
+	return nil
+}
+
+// DialContext connects to the address through Tor, only "tcp" is supported.
+func (t *Tor) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	auth, err := t.auth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d, err := proxy.SOCKS5("tcp", t.Addr(), auth, t.dialer())
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer).DialContext(ctx, network, address)
+}
+
+// Dial connects to the address through Tor.
+func (t *Tor) Dial(network, address string) (net.Conn, error) {
+	return t.DialContext(context.Background(), network, address)
+}
+
+// Dialer returns the dialer connecting through Tor, which also
+// implements proxy.ContextDialer.
+func (t *Tor) Dialer() proxy.Dialer {
+	return t
+}
+
+// Transport returns an http.Transport routing requests through Tor. The
+// isolation key of WithTorIsolation is taken from the request context,
+// and pooled connections are only reused by requests of the same key.
+func (t *Tor) Transport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 t.proxy,
+		DialContext:           t.dialer().DialContext,
+		DisableKeepAlives:     t.Isolate,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// proxy returns the proxy of the request with the credentials isolating
+// it, which are a part of the key of pooled connections.
+func (t *Tor) proxy(req *http.Request) (*url.URL, error) {
+	auth, err := t.auth(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	u := &url.URL{Scheme: "socks5", Host: t.Addr()}
+	if auth != nil {
+		u.User = url.UserPassword(auth.User, auth.Password)
+	}
+	return u, nil
+}
+
+// auth returns the credentials isolating the stream, nil if not isolated.
+func (t *Tor) auth(ctx context.Context) (*proxy.Auth, error) {
+	if key, ok := ctx.Value(torIsolationKey{}).(string); ok && key != "" {
+		if len(key) > 255 {
+			key = key[:255]
+		}
+		return &proxy.Auth{User: key, Password: "isolation"}, nil
+	}
+	if !t.Isolate {
+		return nil, nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &proxy.Auth{User: hex.EncodeToString(b), Password: "isolation"}, nil
+}
@@ -8,148 +8,243 @@ Package helper handles common functions for the waybackk application in Golang.
 package helper // import "github.com/wabarc/helper"
 
 import (
-	"io/ioutil"
-	"net/http"
+	"context"
+	"fmt"
 	"net/url"
+	"sort"
 	"strings"
-	"time"
-
-	"mvdan.cc/xurls/v2"
 )
 
 // MatchURL is extract URL from text, returns []string always.
 func MatchURL(text string) []string {
-	urls := []string{}
-	rx := xurls.Strict()
-	matches := rx.FindAllString(text, -1)
-	for _, el := range matches {
-		urls = append(urls, strip(el))
-	}
-
-	return urls
+	return defaultRuleSet.MatchURL(text)
 }
 
-// MatchURLFallback is extract URL from text, and convert to
-// Google cache endpoint if not found, returns []string always.
+// MatchURLFallback is extract URL from text, and convert to the
+// archived copy if not found, returns []string always.
 func MatchURLFallback(text string) []string {
-	urls := []string{}
-	rx := xurls.Strict()
-	matches := rx.FindAllString(text, -1)
-	cache := "https://webcache.googleusercontent.com/search?q=cache:"
-	for _, el := range matches {
-		uri := strip(el)
-		if NotFound(uri) {
-			uri = cache + uri
-		}
-		urls = append(urls, uri)
-	}
-
-	return urls
+	return defaultRuleSet.MatchURLFallback(text)
 }
 
-// IsURL returns a result of validation for string.
+// IsURL returns a result of validation for string, see Validator for
+// details of the validation.
 func IsURL(str string) bool {
-	u, err := url.Parse(str)
-	if err != nil {
-		return false
-	}
+	_, err := (&Validator{}).Validate(str)
+	return err == nil
+}
+
+// NormalizeLevel represents how aggressive NormalizeURL is, see
+// RFC 3986 section 6 for details.
+type NormalizeLevel int
+
+// Normalization levels, each level includes the previous ones.
+const (
+	// NormalizeSafe applies semantics-preserving normalizations: lowercase
+	// scheme and host, uppercase percent-encoding, decode unreserved
+	// characters, remove default port and dot-segments, and use "/" for
+	// an empty path.
+	NormalizeSafe NormalizeLevel = iota
+
+	// NormalizeUsuallySafe also removes the trailing dot of host, the
+	// fragment and the empty query.
+	NormalizeUsuallySafe
+
+	// NormalizeAggressive also removes the "www." prefix of host, the
+	// directory index, duplicate slashes, and sorts the query.
+	NormalizeAggressive
+)
 
-	return u.Scheme != "" && strings.Contains(u.Host, ".")
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+	"ftp":   "21",
 }
 
-// NotFound returns a result of URI status is 404
-func NotFound(uri string) bool {
-	if _, err := url.Parse(uri); err != nil {
-		return true
-	}
+var directoryIndexes = []string{
+	"index.html",
+	"index.htm",
+	"index.shtml",
+	"index.php",
+	"default.asp",
+	"default.aspx",
+}
 
-	req, err := http.NewRequest(http.MethodHead, uri, nil)
+// NormalizeURL returns the canonical form of link with the given level,
+// which could be used as a key to identify the same resource.
+func NormalizeURL(link string, level NormalizeLevel) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
 	if err != nil {
-		return true
+		return "", err
 	}
-	ua := `Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/99.0.7113.093 Safari/537.36`
-	req.Header.Set("User-Agent", ua)
-
-	noRedirect := func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("not an absolute URL: %s", link)
 	}
-	client := &http.Client{Timeout: 10 * time.Second, CheckRedirect: noRedirect}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return true
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == defaultPorts[scheme] {
+		port = ""
+	}
+	if level >= NormalizeUsuallySafe {
+		host = strings.TrimSuffix(host, ".")
+	}
+	if level >= NormalizeAggressive {
+		host = strings.TrimPrefix(host, "www.")
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
 	}
-	defer resp.Body.Close()
-
-	return resp.StatusCode == http.StatusNotFound
-}
 
-func strip(link string) string {
-	u, err := url.Parse(link)
-	if err != nil {
-		return ""
-	}
-
-	var p = strings.HasPrefix
-	var e = strings.EqualFold
-	var maps = map[string]func(string, string) bool{
-		"utm_":      p,
-		"at_custom": p,
-		"at_medium": p,
-		"weibo_id":  e,
-		"fbclid":    e,
-		"chksm":     e,
-	}
-	queries := u.Query()
-	for key := range queries {
-		for prefix, v := range maps {
-			if v(key, prefix) {
-				queries.Del(key)
+	path := removeDotSegments(normalizeEscape(u.EscapedPath()))
+	if level >= NormalizeAggressive {
+		for strings.Contains(path, "//") {
+			path = strings.ReplaceAll(path, "//", "/")
+		}
+		for _, index := range directoryIndexes {
+			if strings.HasSuffix(path, "/"+index) {
+				path = strings.TrimSuffix(path, index)
+				break
 			}
 		}
 	}
+	if path == "" {
+		path = "/"
+	}
 
-	u.RawQuery = queries.Encode()
-
-	return u.String()
-}
+	var b strings.Builder
+	b.WriteString(scheme + "://")
+	if u.User != nil {
+		b.WriteString(u.User.String() + "@")
+	}
+	b.WriteString(host)
+	if port != "" {
+		b.WriteString(":" + port)
+	}
+	b.WriteString(path)
 
-// RealURI returns final URL
-func RealURI(u *url.URL) *url.URL {
-	resp, err := http.Head(u.String())
-	if err != nil {
-		return u
+	query := normalizeEscape(u.RawQuery)
+	if level >= NormalizeAggressive && query != "" {
+		pairs := strings.Split(query, "&")
+		sort.SliceStable(pairs, func(i, j int) bool {
+			ki, kj := strings.SplitN(pairs[i], "=", 2)[0], strings.SplitN(pairs[j], "=", 2)[0]
+			return ki < kj
+		})
+		query = strings.Join(pairs, "&")
+	}
+	if query != "" || (u.ForceQuery && level < NormalizeUsuallySafe) {
+		b.WriteString("?" + query)
+	}
+	if level < NormalizeUsuallySafe && u.Fragment != "" {
+		b.WriteString("#" + normalizeEscape(u.EscapedFragment()))
 	}
-	defer resp.Body.Close()
 
-	return resp.Request.URL
+	return b.String(), nil
 }
 
-func TinyURL(link string) string {
-	_, err := url.Parse(link)
-	if err != nil {
-		return ""
+// normalizeEscape uppercases percent-encodings and decodes the
+// percent-encoded unreserved characters.
+func normalizeEscape(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
 	}
 
-	resp, err := http.Get("https://tinyurl.com/api-create.php?url=" + link)
-	if err != nil {
-		return ""
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
 	}
-	defer resp.Body.Close()
+	return b.String()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return ""
+// removeDotSegments implements the algorithm of RFC 3986 section 5.2.4.
+func removeDotSegments(path string) string {
+	var out []string
+	in := path
+	for in != "" {
+		switch {
+		case strings.HasPrefix(in, "../"):
+			in = in[3:]
+		case strings.HasPrefix(in, "./"):
+			in = in[2:]
+		case strings.HasPrefix(in, "/./"):
+			in = in[2:]
+		case in == "/.":
+			in = "/"
+		case strings.HasPrefix(in, "/../"):
+			in = in[3:]
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case in == "/..":
+			in = "/"
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case in == "." || in == "..":
+			in = ""
+		default:
+			i := strings.IndexByte(in[1:], '/')
+			if i < 0 {
+				out = append(out, in)
+				in = ""
+			} else {
+				out = append(out, in[:i+1])
+				in = in[i+1:]
+			}
+		}
 	}
+	return strings.Join(out, "")
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return ""
-	}
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
 
-	final := string(body)
-	if final != "Error" {
-		return final
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
 	}
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// NotFound returns a result of URI status is 404
+func NotFound(uri string) bool {
+	return DefaultClient.NotFound(context.Background(), uri)
+}
 
-	return ""
+func strip(link string) string {
+	return defaultRuleSet.Strip(link)
+}
+
+// RealURI returns final URL
+func RealURI(u *url.URL) *url.URL {
+	return DefaultClient.RealURI(context.Background(), u)
+}
+
+// TinyURL returns the short link of tinyurl.com, and an empty string
+// if failed.
+func TinyURL(link string) string {
+	short, _ := DefaultClient.TinyURL(context.Background(), link)
+	return short
 }
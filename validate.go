@@ -0,0 +1,203 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package helper // import "github.com/wabarc/helper"
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// hostProfile is the lookup profile of IDNA without the STD3 rules and
+// hyphen checks, which reject real hosts, such as underscores in labels
+// and "r3---sn-4g5e6nsz.googlevideo.com" of YouTube.
+var hostProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.CheckJoiners(true),
+	idna.StrictDomainName(false),
+	idna.CheckHyphens(false),
+)
+
+// URLError records the reason of an invalid URL.
+type URLError struct {
+	URL    string
+	Reason string
+}
+
+func (e *URLError) Error() string {
+	return "invalid url " + strconv.Quote(e.URL) + ": " + e.Reason
+}
+
+// ValidURL is a URL accepted by Validator.
+type ValidURL struct {
+	URL         string   // The URL with host in ASCII (punycode)
+	Host        string   // Host in ASCII
+	UnicodeHost string   // Host in Unicode, for display
+	Warnings    []string // Suspicious parts of the URL, e.g. homographs
+}
+
+// Validator validates URLs. The zero value accepts URLs of any scheme
+// with a host that contains a dot or is an IP address.
+type Validator struct {
+	// Schemes are the allowed schemes, empty allows all schemes.
+	Schemes []string
+
+	// PublicSuffix requires the host to be under a public suffix
+	// of the ICANN section of the public suffix list.
+	PublicSuffix bool
+}
+
+// Validate validates str, it returns *URLError if rejected.
+func (v *Validator) Validate(str string) (*ValidURL, error) {
+	reject := func(reason string) (*ValidURL, error) {
+		return nil, &URLError{URL: str, Reason: reason}
+	}
+
+	u, err := url.Parse(str)
+	if err != nil {
+		return reject(strings.TrimPrefix(err.Error(), "parse "+strconv.Quote(str)+": "))
+	}
+	switch {
+	case u.Scheme == "":
+		return reject("missing scheme")
+	case !v.allow(u.Scheme):
+		return reject("scheme " + u.Scheme + " not allowed")
+	case u.Opaque != "" || u.Host == "":
+		return reject("missing host")
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return reject("invalid port " + port)
+		}
+	} else if strings.HasSuffix(u.Host, ":") {
+		return reject("empty port")
+	}
+
+	valid := &ValidURL{}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		valid.Host, valid.UnicodeHost, valid.URL = host, host, u.String()
+		return valid, nil
+	}
+
+	host = strings.TrimSuffix(host, ".")
+	if !strings.Contains(host, ".") {
+		return reject("host " + u.Hostname() + " is not a domain")
+	}
+	ascii, err := hostProfile.ToASCII(host)
+	if err != nil {
+		return reject("invalid host: " + err.Error())
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if label == "" {
+			return reject("empty label in host")
+		}
+	}
+	unicodeHost, err := idna.Display.ToUnicode(ascii)
+	if err != nil {
+		unicodeHost = ascii
+	}
+
+	if v.PublicSuffix {
+		suffix, icann := publicsuffix.PublicSuffix(ascii)
+		switch {
+		case !icann && !strings.Contains(suffix, "."):
+			return reject("unknown public suffix " + suffix)
+		case suffix == ascii:
+			return reject("host " + ascii + " is a public suffix")
+		}
+	}
+
+	valid.Host, valid.UnicodeHost = ascii, unicodeHost
+	valid.Warnings = homographs(unicodeHost)
+
+	if port := u.Port(); port != "" {
+		u.Host = ascii + ":" + port
+	} else {
+		u.Host = ascii
+	}
+	valid.URL = u.String()
+
+	return valid, nil
+}
+
+func (v *Validator) allow(scheme string) bool {
+	if len(v.Schemes) == 0 {
+		return true
+	}
+	for _, s := range v.Schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// latinLookalikes are the Cyrillic and Greek letters look like Latin letters.
+const latinLookalikes = "аеорсухіјѕԁԛԝһӏαορυνικχ"
+
+// scriptsAllowed are the scripts usually mixed in a domain label.
+var scriptsAllowed = map[string]bool{
+	"Han,Hiragana":          true,
+	"Han,Katakana":          true,
+	"Hiragana,Katakana":     true,
+	"Han,Hiragana,Katakana": true,
+	"Hangul,Han":            true,
+	"Han,Latin":             true,
+	"Hiragana,Latin":        true,
+	"Katakana,Latin":        true,
+	"Hangul,Latin":          true,
+}
+
+// homographs returns warnings of labels that mix scripts or spoof Latin.
+func homographs(host string) (warnings []string) {
+	for _, label := range strings.Split(host, ".") {
+		scripts := labelScripts(label)
+		switch {
+		case len(scripts) > 1 && !scriptsAllowed[strings.Join(scripts, ",")]:
+			warnings = append(warnings, "label "+label+" mixes scripts "+strings.Join(scripts, ", "))
+		case len(scripts) == 1 && (scripts[0] == "Cyrillic" || scripts[0] == "Greek") && spoofsLatin(label):
+			warnings = append(warnings, "label "+label+" looks like Latin")
+		}
+	}
+	return warnings
+}
+
+func labelScripts(label string) []string {
+	seen := make(map[string]bool)
+	for _, r := range label {
+		if r < unicode.MaxASCII && !unicode.IsLetter(r) {
+			continue
+		}
+		for name, table := range unicode.Scripts {
+			if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+				seen[name] = true
+				break
+			}
+		}
+	}
+	scripts := make([]string, 0, len(seen))
+	for name := range seen {
+		scripts = append(scripts, name)
+	}
+	sort.Strings(scripts)
+	return scripts
+}
+
+func spoofsLatin(label string) bool {
+	for _, r := range label {
+		if r != '-' && !unicode.IsDigit(r) && !strings.ContainsRune(latinLookalikes, r) {
+			return false
+		}
+	}
+	return true
+}